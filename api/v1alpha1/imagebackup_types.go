@@ -0,0 +1,71 @@
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ImageBackupSpec identifies a backup
+type ImageBackupSpec struct {
+	// Image the backup was copied from
+	Source string `json:"source"`
+	// Reference of the backup
+	Backup string `json:"backup"`
+}
+
+// ImageBackupStatus records what the controller observed about a backup
+type ImageBackupStatus struct {
+	// Digest of the source image at the time it was copied
+	// +optional
+	SourceDigest string `json:"sourceDigest,omitempty"`
+	// Digest of the backup
+	// +optional
+	BackupDigest string `json:"backupDigest,omitempty"`
+	// Compressed size of the config and all layers of the backup in bytes
+	// +optional
+	Size int64 `json:"size,omitempty"`
+	// When the backup was first found or created
+	// +optional
+	FirstVerified metav1.Time `json:"firstVerified,omitempty"`
+	// When the backup was last found to exist
+	// +optional
+	LastVerified metav1.Time `json:"lastVerified,omitempty"`
+	// Workloads which reference the backup
+	// +optional
+	Workloads []WorkloadReference `json:"workloads,omitempty"`
+	// Since when the backup is no longer referenced by any workload, as observed by the garbage collection
+	// +optional
+	UnreferencedSince *metav1.Time `json:"unreferencedSince,omitempty"`
+}
+
+// WorkloadReference identifies a workload
+type WorkloadReference struct {
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:scope=Cluster
+
+// ImageBackup records an image copied to the backup registry. It is named after a hash of the backup reference.
+// The controller is its only writer, so the status is not a subresource and written together with the spec
+type ImageBackup struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   ImageBackupSpec   `json:"spec,omitempty"`
+	Status ImageBackupStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// ImageBackupList contains a list of ImageBackup
+type ImageBackupList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ImageBackup `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&ImageBackup{}, &ImageBackupList{})
+}
@@ -0,0 +1,85 @@
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ConditionValid reports whether the spec of a policy is valid. Invalid policies are ignored by the controller
+const ConditionValid = "Valid"
+
+// ImageClonePolicySpec configures how images of workloads are backed up
+type ImageClonePolicySpec struct {
+	// Registry backups are copied to, e.g. registry.example.com/backup/. Defaults to the backup registry of the controller. Only allowed in ClusterImageClonePolicies
+	// +optional
+	DestinationRegistry string `json:"destinationRegistry,omitempty"`
+	// Only images matching any of these patterns are backed up. '*' matches any sequence of characters.
+	// Defaults to all images
+	// +optional
+	IncludeImages []string `json:"includeImages,omitempty"`
+	// Images matching any of these patterns are neither backed up nor rewritten
+	// +optional
+	ExcludeImages []string `json:"excludeImages,omitempty"`
+	// Rewrite workloads to use the backups. If false, images are still backed up, but workloads are only audited.
+	// Defaults to true
+	// +optional
+	Rewrite *bool `json:"rewrite,omitempty"`
+	// Interval after which workloads are reconciled again, e.g. to restore deleted backups. Disabled if unset
+	// +optional
+	ResyncInterval *metav1.Duration `json:"resyncInterval,omitempty"`
+}
+
+// ImageClonePolicyStatus reports whether the policy is in use
+type ImageClonePolicyStatus struct {
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:resource:scope=Namespaced
+
+// ImageClonePolicy configures backups of all workloads in its namespace. If a namespace contains multiple policies,
+// the first valid one by name is used
+type ImageClonePolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   ImageClonePolicySpec   `json:"spec,omitempty"`
+	Status ImageClonePolicyStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// ImageClonePolicyList contains a list of ImageClonePolicy
+type ImageClonePolicyList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ImageClonePolicy `json:"items"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:resource:scope=Cluster
+
+// ClusterImageClonePolicy is the default policy of all namespaces without an ImageClonePolicy. If multiple exist,
+// the first valid one by name is used
+type ClusterImageClonePolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   ImageClonePolicySpec   `json:"spec,omitempty"`
+	Status ImageClonePolicyStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// ClusterImageClonePolicyList contains a list of ClusterImageClonePolicy
+type ClusterImageClonePolicyList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ClusterImageClonePolicy `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&ImageClonePolicy{}, &ImageClonePolicyList{}, &ClusterImageClonePolicy{}, &ClusterImageClonePolicyList{})
+}
@@ -0,0 +1,229 @@
+// Package auditlog writes a tamper-evident log of the backups and rewrites performed by the controller as JSON lines.
+// Every entry contains the HMAC of the previous one, so modifying or removing entries breaks the chain. The HMACs are
+// keyed with a secret, so only holders of the key can forge a valid chain
+package auditlog
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Action taken by the controller
+type Action string
+
+const (
+	// ActionCopied is recorded when an image was copied to the backup registry
+	ActionCopied Action = "copied"
+	// ActionExists is recorded when the backup of an image already existed
+	ActionExists Action = "exists"
+	// ActionCopyFailed is recorded when an image could not be copied
+	ActionCopyFailed Action = "copy-failed"
+	// ActionRewritten is recorded for every container rewritten to its backup
+	ActionRewritten Action = "rewritten"
+	// ActionAudited is recorded for every container, which would be rewritten in enforce mode
+	ActionAudited Action = "audited"
+)
+
+// Entry is a single record of the audit log
+type Entry struct {
+	Time      time.Time `json:"time"`
+	Action    Action    `json:"action"`
+	Kind      string    `json:"kind,omitempty"`
+	Namespace string    `json:"namespace,omitempty"`
+	Name      string    `json:"name,omitempty"`
+	Container string    `json:"container,omitempty"`
+	Source    string    `json:"source"`
+	// SourceDigest and BackupDigest are empty if they could not be resolved
+	SourceDigest string `json:"sourceDigest,omitempty"`
+	Backup       string `json:"backup,omitempty"`
+	BackupDigest string `json:"backupDigest,omitempty"`
+	Error        string `json:"error,omitempty"`
+
+	// Seq, PrevHash and Hash are set by the Writer. Hash is the HMAC-SHA256 of the entry
+	Seq      uint64 `json:"seq"`
+	PrevHash string `json:"prevHash"`
+	Hash     string `json:"hash"`
+}
+
+// ErrNoKey is returned if the audit log is opened or verified without a key
+var ErrNoKey = errors.New("the audit log requires a key")
+
+// Sink records entries of the audit log
+type Sink interface {
+	Record(Entry) error
+}
+
+// Writer is a Sink writing hash chained JSON lines. It is safe for concurrent use
+type Writer struct {
+	mu   sync.Mutex
+	w    io.Writer
+	key  []byte
+	seq  uint64
+	prev string
+}
+
+var _ Sink = (*Writer)(nil)
+
+// NewWriter returns a Writer starting a new chain on w, which is keyed with key
+func NewWriter(w io.Writer, key []byte) *Writer {
+	return &Writer{w: w, key: key}
+}
+
+// Open returns a Writer appending to the file at path, continuing the chain of its existing entries, which must have
+// been written with the same key. A path of "-" writes to stdout
+func Open(path string, key []byte) (*Writer, error) {
+	if len(key) == 0 {
+		return nil, ErrNoKey
+	}
+	if path == "-" {
+		return NewWriter(os.Stdout, key), nil
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	last, err := lastEntry(f, key)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("could not continue audit log %s: %w", path, err)
+	}
+	w := NewWriter(f, key)
+	if last != nil {
+		w.seq = last.Seq
+		w.prev = last.Hash
+	}
+	return w, nil
+}
+
+// Record sets the time if it is empty, chains e to the previous entry and writes it
+func (w *Writer) Record(e Entry) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	e.Time = e.Time.UTC()
+	e.Seq = w.seq + 1
+	e.PrevHash = w.prev
+	hash, err := e.hash(w.key)
+	if err != nil {
+		return err
+	}
+	e.Hash = hash
+
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := w.w.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	w.seq = e.Seq
+	w.prev = e.Hash
+	return nil
+}
+
+// hash returns the HMAC of e keyed with key, excluding its Hash field
+func (e Entry) hash(key []byte) (string, error) {
+	e.Hash = ""
+	b, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(b)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// verify reports whether the Hash of e is its HMAC keyed with key
+func (e Entry) verify(key []byte) (bool, error) {
+	hash, err := e.hash(key)
+	if err != nil {
+		return false, err
+	}
+	return hmac.Equal([]byte(hash), []byte(e.Hash)), nil
+}
+
+// Verify checks the chain of the audit log read from r, which was written with key, and returns the number of entries.
+// The first entry may continue a chain, to allow verifying rotated logs. Removing entries from the end of a log can not
+// be detected
+func Verify(r io.Reader, key []byte) (int, error) {
+	if len(key) == 0 {
+		return 0, ErrNoKey
+	}
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	n := 0
+	var prev *Entry
+	for s.Scan() {
+		if len(bytes.TrimSpace(s.Bytes())) == 0 {
+			continue
+		}
+		n++
+		e := &Entry{}
+		if err := json.Unmarshal(s.Bytes(), e); err != nil {
+			return n, fmt.Errorf("entry %d: %w", n, err)
+		}
+		ok, err := e.verify(key)
+		if err != nil {
+			return n, err
+		}
+		if !ok {
+			return n, fmt.Errorf("entry %d (seq %d): hash mismatch, the entry was modified or written with another key", n, e.Seq)
+		}
+		if prev != nil && (e.PrevHash != prev.Hash || e.Seq != prev.Seq+1) {
+			return n, fmt.Errorf("entry %d (seq %d): chain broken after seq %d, entries were modified or removed", n, e.Seq, prev.Seq)
+		}
+		prev = e
+	}
+	return n, s.Err()
+}
+
+// lastEntry returns the last entry of the log in f, or nil if it is empty. The entry must have been written with key
+func lastEntry(f *os.File, key []byte) (*Entry, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	s := bufio.NewScanner(f)
+	s.Buffer(make([]byte, 64*1024), 1024*1024)
+	var last []byte
+	for s.Scan() {
+		if len(bytes.TrimSpace(s.Bytes())) > 0 {
+			last = append(last[:0], s.Bytes()...)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if last == nil {
+		return nil, nil
+	}
+	e := &Entry{}
+	if err := json.Unmarshal(last, e); err != nil {
+		return nil, err
+	}
+	if e.Hash == "" {
+		return nil, errors.New("last entry has no hash")
+	}
+	ok, err := e.verify(key)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errors.New("last entry was modified or written with another key")
+	}
+	return e, nil
+}
@@ -0,0 +1,107 @@
+package auditlog
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var testKey = []byte("secret")
+
+func TestRecordAndVerify(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf, testKey)
+	entries := []Entry{
+		{Action: ActionCopied, Kind: "Deployment", Namespace: "test", Name: "app", Source: "nginx:1.21", Backup: "backup/library_nginx:1.21"},
+		{Action: ActionRewritten, Kind: "Deployment", Namespace: "test", Name: "app", Container: "nginx", Source: "nginx:1.21", Backup: "backup/library_nginx:1.21"},
+		{Action: ActionCopyFailed, Source: "busybox:1.34", Error: "not found"},
+	}
+	for _, e := range entries {
+		if err := w.Record(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	log := buf.String()
+
+	tt := map[string]struct {
+		log    string
+		key    []byte
+		expN   int
+		expErr string
+	}{
+		"valid": {
+			log:  log,
+			expN: 3,
+		},
+		"modified entry": {
+			log:    strings.Replace(log, "busybox:1.34", "busybox:1.35", 1),
+			expN:   3,
+			expErr: "hash mismatch",
+		},
+		"other key": {
+			log:    log,
+			key:    []byte("forged"),
+			expN:   1,
+			expErr: "hash mismatch",
+		},
+		"no key": {
+			log:    log,
+			key:    []byte{},
+			expErr: "requires a key",
+		},
+		"removed entry": {
+			log:    strings.Join(append(strings.SplitN(log, "\n", 3)[:1], strings.SplitN(log, "\n", 3)[2]), "\n"),
+			expN:   2,
+			expErr: "chain broken",
+		},
+	}
+
+	for name, tc := range tt {
+		t.Run(name, func(t *testing.T) {
+			key := testKey
+			if tc.key != nil {
+				key = tc.key
+			}
+			n, err := Verify(strings.NewReader(tc.log), key)
+			if n != tc.expN {
+				t.Errorf("Exp %d entries, got %d", tc.expN, n)
+			}
+			if tc.expErr == "" && err != nil {
+				t.Errorf("Exp no error, got '%v'", err)
+			}
+			if tc.expErr != "" && (err == nil || !strings.Contains(err.Error(), tc.expErr)) {
+				t.Errorf("Exp error containing '%s', got '%v'", tc.expErr, err)
+			}
+		})
+	}
+}
+
+func TestOpenContinuesChain(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	for i := 0; i < 2; i++ {
+		w, err := Open(path, testKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Record(Entry{Action: ActionExists, Source: "nginx:1.21"}); err != nil {
+			t.Fatal(err)
+		}
+		w.w.(*os.File).Close()
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	n, err := Verify(f, testKey)
+	if n != 2 || err != nil {
+		t.Errorf("Exp 2 valid entries, got %d, '%v'", n, err)
+	}
+
+	if _, err := Open(path, []byte("forged")); err == nil {
+		t.Error("Exp continuing the chain with another key to fail")
+	}
+}
@@ -0,0 +1,153 @@
+// Package bundle exports images into OCI layouts and imports them into a backup registry, for transferring them into
+// disconnected environments
+package bundle
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/match"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/simontheleg/image-clone-controller/registry"
+)
+
+const (
+	// SourceAnnotation on the manifests in the index.json of a bundle holds the original reference of the image
+	SourceAnnotation = "imageclone.simontheleg.dev/source"
+	// RefNameAnnotation on the manifests in the index.json of a bundle holds the backup reference of the image
+	RefNameAnnotation = "org.opencontainers.image.ref.name"
+)
+
+// Source is an image to export
+type Source struct {
+	// Image is the original reference, which determines the name of the backup
+	Image string
+	// Pull is the reference the image is pulled from, e.g. an existing backup. Defaults to Image
+	Pull string
+}
+
+// ExportOptions configure the naming of images in a bundle and how they are pulled
+type ExportOptions struct {
+	// BackupRegistry and Separator are used to compute the backup references recorded in the bundle
+	BackupRegistry string
+	// Separator for nested repositories in backup references. Defaults to registry.DefaultSeparator
+	Separator string
+	// Only export the manifests of these platforms from image indexes, like registry.RegistryBackUp. Empty exports the
+	// default platform as a single image
+	Platforms []v1.Platform
+	// Auth is used for images pulled from a reference other than their original one, usually the backup registry.
+	// Original images are pulled anonymously
+	Auth authn.Authenticator
+	// Progress is called after each image, with the number of images done and in total. Optional
+	Progress func(done, total int, res ExportResult)
+}
+
+// ExportResult describes the outcome of exporting a single image
+type ExportResult struct {
+	Source string
+	Backup string
+	Digest string
+	Err    error
+}
+
+// Export pulls all images and writes them to an OCI layout at path, which must not exist yet or be an OCI layout
+// written by Export. Multi platform images are exported like backups, depending on opts.Platforms. The index.json of the
+// layout maps the original reference of every image, recorded in the SourceAnnotation, to its digest. Images already in
+// the layout are replaced.
+// Errors of single images are reported in their ExportResult
+func Export(ctx context.Context, path string, srcs []Source, opts ExportOptions) ([]ExportResult, error) {
+	p, err := layout.FromPath(path)
+	if err != nil {
+		p, err = layout.Write(path, empty.Index)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	res := make([]ExportResult, 0, len(srcs))
+	for i, src := range srcs {
+		er := exportImage(ctx, p, src, opts)
+		res = append(res, er)
+		if opts.Progress != nil {
+			opts.Progress(i+1, len(srcs), er)
+		}
+	}
+	return res, nil
+}
+
+// exportImage writes a single image to the layout, replacing any previous export of the same original reference
+func exportImage(ctx context.Context, p layout.Path, src Source, opts ExportOptions) ExportResult {
+	er := ExportResult{Source: src.Image}
+
+	orgRef, err := name.ParseReference(src.Image)
+	if err != nil {
+		er.Err = err
+		return er
+	}
+	er.Backup = registry.GenBackUpReferenceWithSeparator(opts.BackupRegistry, orgRef, opts.Separator)
+
+	pullRef := orgRef
+	remoteOpts := []remote.Option{remote.WithContext(ctx)}
+	if src.Pull != "" && src.Pull != src.Image {
+		pullRef, err = name.ParseReference(src.Pull)
+		if err != nil {
+			er.Err = err
+			return er
+		}
+		if opts.Auth != nil {
+			remoteOpts = append(remoteOpts, remote.WithAuth(opts.Auth))
+		}
+	}
+
+	desc, err := remote.Get(pullRef, remoteOpts...)
+	if err != nil {
+		er.Err = registry.ClassifyError(err)
+		return er
+	}
+
+	annos := layout.WithAnnotations(map[string]string{
+		SourceAnnotation:  orgRef.Name(),
+		RefNameAnnotation: er.Backup,
+	})
+	prev := match.Annotation(SourceAnnotation, orgRef.Name())
+	var digest v1.Hash
+	if len(opts.Platforms) > 0 && desc.MediaType.IsIndex() {
+		idx, err := desc.ImageIndex()
+		if err != nil {
+			er.Err = registry.ClassifyError(err)
+			return er
+		}
+		if idx, err = registry.FilterIndex(idx, opts.Platforms); err != nil {
+			er.Err = err
+			return er
+		}
+		if digest, err = idx.Digest(); err != nil {
+			er.Err = err
+			return er
+		}
+		er.Err = p.ReplaceIndex(idx, prev, annos)
+	} else {
+		// indexes resolve to the default platform
+		img, err := desc.Image()
+		if err != nil {
+			er.Err = registry.ClassifyError(err)
+			return er
+		}
+		if digest, err = img.Digest(); err != nil {
+			er.Err = err
+			return er
+		}
+		er.Err = p.ReplaceImage(img, prev, annos)
+	}
+	if er.Err != nil {
+		er.Err = fmt.Errorf("could not write image to bundle: %w", registry.ClassifyError(er.Err))
+		return er
+	}
+	er.Digest = digest.String()
+	return er
+}
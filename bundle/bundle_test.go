@@ -0,0 +1,182 @@
+package bundle
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	imgregistry "github.com/simontheleg/image-clone-controller/registry"
+)
+
+// platforms of the index served by testRegistry
+var testPlatforms = []v1.Platform{{OS: "linux", Architecture: "amd64"}, {OS: "linux", Architecture: "arm64"}}
+
+// testRegistry starts a registry serving a random image at vendor/app:v1 and a random index with testPlatforms at
+// vendor/multi:v1
+func testRegistry(t *testing.T) (host string, close func()) {
+	reg := httptest.NewServer(registry.New(registry.Logger(log.New(ioutil.Discard, "", 0))))
+	host = strings.TrimPrefix(reg.URL, "http://")
+
+	img, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, _ := name.ParseReference(host + "/vendor/app:v1")
+	if err := remote.Write(ref, img); err != nil {
+		t.Fatal(err)
+	}
+	idx := mutate.IndexMediaType(empty.Index, types.OCIImageIndex)
+	for i := range testPlatforms {
+		img, err := random.Image(512, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		idx = mutate.AppendManifests(idx, mutate.IndexAddendum{
+			Add:        img,
+			Descriptor: v1.Descriptor{Platform: &testPlatforms[i]},
+		})
+	}
+	ref, _ = name.ParseReference(host + "/vendor/multi:v1")
+	if err := remote.WriteIndex(ref, idx); err != nil {
+		t.Fatal(err)
+	}
+	return host, reg.Close
+}
+
+func TestExport(t *testing.T) {
+	host, closeReg := testRegistry(t)
+	defer closeReg()
+	dir := t.TempDir()
+
+	srcs := []Source{
+		{Image: host + "/vendor/app:v1"},
+		{Image: "nginx:1.21", Pull: host + "/vendor/multi:v1"},
+		{Image: host + "/vendor/missing:v1"},
+	}
+	progress := 0
+	res, err := Export(context.Background(), dir, srcs, ExportOptions{
+		BackupRegistry: "backup",
+		Platforms:      testPlatforms[1:],
+		Progress:       func(done, total int, res ExportResult) { progress = done },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if progress != 3 || len(res) != 3 {
+		t.Fatalf("Exp 3 results, got %d after progress %d", len(res), progress)
+	}
+	if res[0].Err != nil || res[1].Err != nil {
+		t.Fatalf("Exp no errors, got '%v', '%v'", res[0].Err, res[1].Err)
+	}
+	if !errors.Is(res[2].Err, imgregistry.ErrNotFound) {
+		t.Errorf("Exp '%v', got '%v'", imgregistry.ErrNotFound, res[2].Err)
+	}
+	if res[1].Backup != "backup/library_nginx:1.21" {
+		t.Errorf("Exp backup reference 'backup/library_nginx:1.21', got '%s'", res[1].Backup)
+	}
+
+	p, err := layout.FromPath(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err := p.ImageIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := idx.IndexManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Manifests) != 2 {
+		t.Fatalf("Exp 2 manifests in bundle, got %d", len(m.Manifests))
+	}
+	for i, desc := range m.Manifests {
+		orig, _ := name.ParseReference(srcs[i].Image)
+		if desc.Annotations[SourceAnnotation] != orig.Name() || desc.Digest.String() != res[i].Digest {
+			t.Errorf("Exp manifest %d to map '%s' to '%s', got %+v", i, orig.Name(), res[i].Digest, desc)
+		}
+	}
+	if !m.Manifests[1].MediaType.IsIndex() {
+		t.Fatalf("Exp multi platform image to be exported as index, got '%s'", m.Manifests[1].MediaType)
+	}
+	multi, err := idx.ImageIndex(m.Manifests[1].Digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mm, err := multi.IndexManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mm.Manifests) != 1 || mm.Manifests[0].Platform.Architecture != "arm64" {
+		t.Errorf("Exp index to be filtered to linux/arm64, got %+v", mm.Manifests)
+	}
+
+	var buf bytes.Buffer
+	if err := Archive(dir, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() == 0 {
+		t.Error("Exp archive to be written")
+	}
+}
+
+func TestExportDefaultPlatform(t *testing.T) {
+	host, closeReg := testRegistry(t)
+	defer closeReg()
+	dir := t.TempDir()
+
+	srcs := []Source{{Image: host + "/vendor/multi:v1"}}
+	ref, _ := name.ParseReference(host + "/vendor/multi:v1")
+	exp, err := remote.Image(ref, remote.WithPlatform(testPlatforms[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expDigest, err := exp.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// exporting twice replaces the first export
+	for i := 0; i < 2; i++ {
+		res, err := Export(context.Background(), dir, srcs, ExportOptions{BackupRegistry: "backup"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res[0].Err != nil || res[0].Digest != expDigest.String() {
+			t.Fatalf("Exp default platform '%s' to be exported, got %+v", expDigest, res[0])
+		}
+	}
+
+	p, err := layout.FromPath(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err := p.ImageIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := idx.IndexManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Manifests) != 1 {
+		t.Fatalf("Exp 1 manifest in bundle, got %+v", m.Manifests)
+	}
+	if !m.Manifests[0].MediaType.IsImage() || m.Manifests[0].Digest != expDigest {
+		t.Errorf("Exp image '%s', got %+v", expDigest, m.Manifests[0])
+	}
+}
@@ -0,0 +1,144 @@
+package bundle
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/simontheleg/image-clone-controller/registry"
+)
+
+// ImportOptions configure where the images of a bundle are pushed to
+type ImportOptions struct {
+	// BackupRegistry and Separator are used to compute the backup references, the same way the controller does
+	BackupRegistry string
+	// Separator for nested repositories in backup references. Defaults to registry.DefaultSeparator
+	Separator string
+	Auth      authn.Authenticator
+	// Progress is called after each image, with the number of images done and in total. Optional
+	Progress func(done, total int, res ImportResult)
+}
+
+// ImportResult describes the outcome of importing a single image
+type ImportResult struct {
+	Source string
+	Backup string
+	Digest string
+	// Skipped is set if the backup already existed with the same digest
+	Skipped bool
+	Err     error
+}
+
+// Import pushes all images of the OCI layout at path, written by Export, to their backup references in the backup
+// registry. The digest of every image is verified against the bundle before and against the registry after pushing.
+// Errors of single images are reported in their ImportResult
+func Import(ctx context.Context, path string, opts ImportOptions) ([]ImportResult, error) {
+	p, err := layout.FromPath(path)
+	if err != nil {
+		return nil, err
+	}
+	idx, err := p.ImageIndex()
+	if err != nil {
+		return nil, err
+	}
+	m, err := idx.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]ImportResult, 0, len(m.Manifests))
+	for i, desc := range m.Manifests {
+		ir := importImage(ctx, idx, desc, opts)
+		res = append(res, ir)
+		if opts.Progress != nil {
+			opts.Progress(i+1, len(m.Manifests), ir)
+		}
+	}
+	return res, nil
+}
+
+// importImage pushes the image described by desc to its backup reference
+func importImage(ctx context.Context, idx v1.ImageIndex, desc v1.Descriptor, opts ImportOptions) ImportResult {
+	ir := ImportResult{Source: desc.Annotations[SourceAnnotation], Digest: desc.Digest.String()}
+	if ir.Source == "" {
+		ir.Err = fmt.Errorf("manifest %s has no %s annotation", desc.Digest, SourceAnnotation)
+		return ir
+	}
+	orgRef, err := name.ParseReference(ir.Source)
+	if err != nil {
+		ir.Err = err
+		return ir
+	}
+	buRef, err := name.ParseReference(registry.GenBackUpReferenceWithSeparator(opts.BackupRegistry, orgRef, opts.Separator))
+	if err != nil {
+		ir.Err = err
+		return ir
+	}
+	ir.Backup = buRef.Name()
+
+	remoteOpts := []remote.Option{remote.WithContext(ctx)}
+	if opts.Auth != nil {
+		remoteOpts = append(remoteOpts, remote.WithAuth(opts.Auth))
+	}
+
+	if cur, err := remote.Head(buRef, remoteOpts...); err == nil && cur.Digest == desc.Digest {
+		ir.Skipped = true
+		return ir
+	}
+
+	if desc.MediaType.IsIndex() {
+		ii, err := idx.ImageIndex(desc.Digest)
+		if err != nil {
+			ir.Err = err
+			return ir
+		}
+		if ir.Err = verifyDigest(ii, desc.Digest); ir.Err != nil {
+			return ir
+		}
+		err = remote.WriteIndex(buRef, ii, remoteOpts...)
+		if err != nil {
+			ir.Err = registry.ClassifyError(err)
+			return ir
+		}
+	} else {
+		img, err := idx.Image(desc.Digest)
+		if err != nil {
+			ir.Err = err
+			return ir
+		}
+		if ir.Err = verifyDigest(img, desc.Digest); ir.Err != nil {
+			return ir
+		}
+		err = remote.Write(buRef, img, remoteOpts...)
+		if err != nil {
+			ir.Err = registry.ClassifyError(err)
+			return ir
+		}
+	}
+
+	pushed, err := remote.Head(buRef, remoteOpts...)
+	if err != nil {
+		ir.Err = registry.ClassifyError(err)
+		return ir
+	}
+	if pushed.Digest != desc.Digest {
+		ir.Err = fmt.Errorf("digest mismatch after push: expected %s, got %s", desc.Digest, pushed.Digest)
+	}
+	return ir
+}
+
+// verifyDigest checks that the manifest read from the bundle matches the digest recorded in its index.json
+func verifyDigest(m interface{ Digest() (v1.Hash, error) }, exp v1.Hash) error {
+	got, err := m.Digest()
+	if err != nil {
+		return err
+	}
+	if got != exp {
+		return fmt.Errorf("digest mismatch in bundle: expected %s, got %s", exp, got)
+	}
+	return nil
+}
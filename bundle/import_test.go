@@ -0,0 +1,120 @@
+package bundle
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"log"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+func TestImport(t *testing.T) {
+	host, closeReg := testRegistry(t)
+	defer closeReg()
+	dst := httptest.NewServer(registry.New(registry.Logger(log.New(ioutil.Discard, "", 0))))
+	defer dst.Close()
+	dstReg := strings.TrimPrefix(dst.URL, "http://") + "/backup"
+
+	exported := t.TempDir()
+	exps, err := Export(context.Background(), exported, []Source{
+		{Image: "nginx:1.21", Pull: host + "/vendor/app:v1"},
+		{Image: "quay.io/prometheus/node-exporter:v1.2.2", Pull: host + "/vendor/multi:v1"},
+	}, ExportOptions{BackupRegistry: "imageclonebackupregistry", Platforms: testPlatforms})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// transfer the bundle as archive
+	var buf bytes.Buffer
+	if err := Archive(exported, &buf); err != nil {
+		t.Fatal(err)
+	}
+	imported := t.TempDir()
+	if err := Extract(&buf, imported); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := ImportOptions{BackupRegistry: dstReg}
+	res, err := Import(context.Background(), imported, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expBackups := []string{dstReg + "/library_nginx:1.21", dstReg + "/prometheus_node-exporter:v1.2.2"}
+	if len(res) != len(expBackups) {
+		t.Fatalf("Exp %d results, got %+v", len(expBackups), res)
+	}
+	for i, ir := range res {
+		if ir.Err != nil || ir.Skipped || ir.Backup != expBackups[i] {
+			t.Errorf("Exp '%s' to be imported, got %+v", expBackups[i], ir)
+			continue
+		}
+		ref, _ := name.ParseReference(ir.Backup)
+		desc, err := remote.Head(ref)
+		if err != nil || desc.Digest.String() != exps[i].Digest {
+			t.Errorf("Exp '%s' to point to '%s', got %v, '%v'", ir.Backup, exps[i].Digest, desc, err)
+		}
+	}
+
+	res, err = Import(context.Background(), imported, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ir := range res {
+		if ir.Err != nil || !ir.Skipped {
+			t.Errorf("Exp existing backup to be skipped, got %+v", ir)
+		}
+	}
+}
+
+func TestImportTampered(t *testing.T) {
+	host, closeReg := testRegistry(t)
+	defer closeReg()
+
+	dir := t.TempDir()
+	exps, err := Export(context.Background(), dir, []Source{{Image: host + "/vendor/app:v1"}}, ExportOptions{BackupRegistry: host + "/backup"})
+	if err != nil || exps[0].Err != nil {
+		t.Fatal(err, exps)
+	}
+	blob := filepath.Join(dir, "blobs", "sha256", strings.TrimPrefix(exps[0].Digest, "sha256:"))
+	raw, err := ioutil.ReadFile(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(blob, append(raw, '\n'), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := Import(context.Background(), dir, ImportOptions{BackupRegistry: host + "/backup"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 1 || res[0].Err == nil || !strings.Contains(res[0].Err.Error(), "digest mismatch") {
+		t.Errorf("Exp digest mismatch, got %+v", res)
+	}
+}
+
+func TestExtractInvalidPath(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := tw.WriteHeader(&tar.Header{Name: "../outside", Typeflag: tar.TypeReg, Mode: 0644}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	err := Extract(&buf, dir)
+	if err == nil || !strings.Contains(err.Error(), "invalid path") {
+		t.Errorf("Exp invalid path error, got '%v'", err)
+	}
+}
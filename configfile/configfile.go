@@ -0,0 +1,232 @@
+// Package configfile loads and watches the versioned configuration file of the controller
+package configfile
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/simontheleg/image-clone-controller/registry"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// APIVersion of the configuration file format
+	APIVersion = "imageclone.simontheleg.dev/v1alpha1"
+	// Kind of the configuration file
+	Kind = "ControllerConfiguration"
+)
+
+// Config is the content of the configuration file. Unset fields keep their defaults
+type Config struct {
+	metav1.TypeMeta `json:",inline"`
+
+	// Docker Remote of the backup registry
+	BackupRegistry string `json:"backupRegistry,omitempty"`
+	Naming         Naming `json:"naming,omitempty"`
+	// Platforms as os/arch[/variant] to copy from multi-arch images. Empty copies the default platform only
+	Platforms   []string    `json:"platforms,omitempty"`
+	Namespaces  Namespaces  `json:"namespaces,omitempty"`
+	Concurrency Concurrency `json:"concurrency,omitempty"`
+	Credentials Credentials `json:"credentials,omitempty"`
+	// Either enforce or audit
+	Mode string `json:"mode,omitempty"`
+	// Rewrite successfully backed up containers even if others failed
+	PartialRewrite *bool `json:"partialRewrite,omitempty"`
+	// Still copy images in audit mode
+	AuditCopy *bool `json:"auditCopy,omitempty"`
+	// File to append the audit log of copies and rewrites to, "-" for stdout
+	AuditLog string `json:"auditLog,omitempty"`
+	// File containing the key the audit log is signed with, e.g. mounted from a Secret
+	AuditLogKeyFile string    `json:"auditLogKeyFile,omitempty"`
+	Reconcile       Reconcile `json:"reconcile,omitempty"`
+	Tracing         Tracing   `json:"tracing,omitempty"`
+}
+
+// Naming configures how backup references are generated
+type Naming struct {
+	// Separator replacing slashes of nested repositories. Changes are rejected on reload, as workloads already rewritten
+	// would no longer be recognized as using their backups
+	Separator string `json:"separator,omitempty"`
+}
+
+// Namespaces configures which namespaces are watched
+type Namespaces struct {
+	// Namespaces to ignore. An empty list ignores no namespaces, while leaving it unset keeps the default
+	Ignore []string `json:"ignore,omitempty"`
+	// Label selector namespaces must match to be watched
+	Selector string `json:"selector,omitempty"`
+	// Label selector of namespaces to ignore
+	ExcludeSelector string `json:"excludeSelector,omitempty"`
+}
+
+// Concurrency configures how much work is done in parallel
+type Concurrency struct {
+	// Maximum number of images backed up in parallel per reconcile
+	Backups int `json:"backups,omitempty"`
+}
+
+// Credentials configures where registry credentials are read from
+type Credentials struct {
+	// Location of the Docker config
+	DockerConfig string `json:"dockerConfig,omitempty"`
+	// Subconfig to pick in case multiple exist
+	DockerConfigKey string `json:"dockerConfigKey,omitempty"`
+}
+
+// Reconcile tunes the reconcilers. Unlike the rest of the configuration, changes only take effect after a restart
+type Reconcile struct {
+	// Interval after which the informers deliver all workloads again as a safety net
+	SyncPeriod              *metav1.Duration        `json:"syncPeriod,omitempty"`
+	MaxConcurrentReconciles MaxConcurrentReconciles `json:"maxConcurrentReconciles,omitempty"`
+	RateLimiter             RateLimiter             `json:"rateLimiter,omitempty"`
+}
+
+// MaxConcurrentReconciles configures how many workloads of each kind are reconciled in parallel
+type MaxConcurrentReconciles struct {
+	Deployments int `json:"deployments,omitempty"`
+	DaemonSets  int `json:"daemonSets,omitempty"`
+}
+
+// RateLimiter configures the exponential backoff of failed reconciles
+type RateLimiter struct {
+	BaseDelay *metav1.Duration `json:"baseDelay,omitempty"`
+	MaxDelay  *metav1.Duration `json:"maxDelay,omitempty"`
+}
+
+// Tracing configures the export of OpenTelemetry traces. Changes only take effect after a restart
+type Tracing struct {
+	// Exporter is either stdout or otlp. Empty disables tracing
+	Exporter string `json:"exporter,omitempty"`
+	// Endpoint of the OTLP/HTTP collector as host:port
+	Endpoint string `json:"endpoint,omitempty"`
+	// Connect to the collector without TLS
+	Insecure *bool `json:"insecure,omitempty"`
+}
+
+// separatorRegexp matches the separators allowed between path components of a repository name
+var separatorRegexp = regexp.MustCompile(`^(\.|_|__|-+)$`)
+
+// ValidSeparator checks that sep is allowed between path components of a repository name. Empty selects the default
+func ValidSeparator(sep string) error {
+	if sep != "" && !separatorRegexp.MatchString(sep) {
+		return fmt.Errorf("'%s' is not allowed in repository names", sep)
+	}
+	return nil
+}
+
+// Load reads and validates the configuration file at path
+func Load(path string) (*Config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &Config{}
+	if err := yaml.UnmarshalStrict(b, c); err != nil {
+		return nil, fmt.Errorf("could not parse config file '%s': %w", path, err)
+	}
+	if err := c.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config file '%s': %w", path, err)
+	}
+	return c, nil
+}
+
+// Validate checks the configuration for errors
+func (c *Config) Validate() error {
+	if c.APIVersion != APIVersion {
+		return fmt.Errorf("unsupported apiVersion '%s', expected '%s'", c.APIVersion, APIVersion)
+	}
+	if c.Kind != Kind {
+		return fmt.Errorf("unsupported kind '%s', expected '%s'", c.Kind, Kind)
+	}
+	if err := ValidSeparator(c.Naming.Separator); err != nil {
+		return fmt.Errorf("naming.separator: %w", err)
+	}
+	for _, p := range c.Platforms {
+		if _, err := registry.ParsePlatform(p); err != nil {
+			return fmt.Errorf("platforms: %w", err)
+		}
+	}
+	if _, err := labels.Parse(c.Namespaces.Selector); err != nil {
+		return fmt.Errorf("namespaces.selector: %w", err)
+	}
+	if _, err := labels.Parse(c.Namespaces.ExcludeSelector); err != nil {
+		return fmt.Errorf("namespaces.excludeSelector: %w", err)
+	}
+	if c.Concurrency.Backups < 0 {
+		return fmt.Errorf("concurrency.backups: must not be negative, got %d", c.Concurrency.Backups)
+	}
+	if d := c.Reconcile.SyncPeriod; d != nil && d.Duration <= 0 {
+		return fmt.Errorf("reconcile.syncPeriod: must be positive, got %s", d.Duration)
+	}
+	if n := c.Reconcile.MaxConcurrentReconciles; n.Deployments < 0 || n.DaemonSets < 0 {
+		return errors.New("reconcile.maxConcurrentReconciles: must not be negative")
+	}
+	base, max := c.Reconcile.RateLimiter.BaseDelay, c.Reconcile.RateLimiter.MaxDelay
+	if (base != nil && base.Duration <= 0) || (max != nil && max.Duration <= 0) {
+		return errors.New("reconcile.rateLimiter: delays must be positive")
+	}
+	if base != nil && max != nil && base.Duration > max.Duration {
+		return fmt.Errorf("reconcile.rateLimiter: baseDelay %s exceeds maxDelay %s", base.Duration, max.Duration)
+	}
+	switch c.Mode {
+	case "", "enforce", "audit":
+	default:
+		return fmt.Errorf("mode: unknown mode '%s'", c.Mode)
+	}
+	switch c.Tracing.Exporter {
+	case "", "stdout", "otlp":
+	default:
+		return fmt.Errorf("tracing.exporter: unknown exporter '%s'", c.Tracing.Exporter)
+	}
+	return nil
+}
+
+// Watch calls onChange whenever the file at path changes until ctx is done. The parent directory is watched instead of the
+// file itself, as ConfigMap volumes replace files by swapping symlinks
+func Watch(ctx context.Context, path string, onChange func()) error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	dir, file := filepath.Split(filepath.Clean(path))
+	if dir == "" {
+		dir = "."
+	}
+	if err := w.Add(dir); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case e, ok := <-w.Events:
+			if !ok {
+				return nil
+			}
+			// ConfigMap volumes update the ..data symlink, which the file links to
+			name := filepath.Base(e.Name)
+			if name != file && name != "..data" {
+				continue
+			}
+			if e.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) != 0 {
+				onChange()
+			}
+		case err, ok := <-w.Errors:
+			if !ok {
+				return nil
+			}
+			log.FromContext(ctx).Error(err, "error watching config file", "path", path)
+		}
+	}
+}
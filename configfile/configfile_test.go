@@ -0,0 +1,191 @@
+package configfile
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoad(t *testing.T) {
+	tt := map[string]struct {
+		content string
+		expErr  string
+	}{
+		"valid": {
+			content: `apiVersion: imageclone.simontheleg.dev/v1alpha1
+kind: ControllerConfiguration
+backupRegistry: registry.example.com/backup/
+naming:
+  separator: "--"
+platforms: [linux/amd64, linux/arm64]
+namespaces:
+  ignore: [kube-system]
+  selector: team=a
+concurrency:
+  backups: 8
+credentials:
+  dockerConfig: /docker/config.json
+  dockerConfigKey: example
+mode: audit
+partialRewrite: true
+auditLog: /var/log/audit.jsonl
+auditLogKeyFile: /auditlog/key
+tracing:
+  exporter: otlp
+  endpoint: otel-collector:4318
+reconcile:
+  syncPeriod: 1h
+  maxConcurrentReconciles:
+    deployments: 4
+  rateLimiter:
+    baseDelay: 1s
+    maxDelay: 5m
+`,
+		},
+		"wrong apiVersion": {
+			content: "apiVersion: v1\nkind: ControllerConfiguration\n",
+			expErr:  "unsupported apiVersion",
+		},
+		"wrong kind": {
+			content: "apiVersion: imageclone.simontheleg.dev/v1alpha1\nkind: Config\n",
+			expErr:  "unsupported kind",
+		},
+		"unknown field": {
+			content: "apiVersion: imageclone.simontheleg.dev/v1alpha1\nkind: ControllerConfiguration\nbackupRegistri: foo\n",
+			expErr:  "could not parse",
+		},
+		"invalid tracing exporter": {
+			content: "apiVersion: imageclone.simontheleg.dev/v1alpha1\nkind: ControllerConfiguration\ntracing:\n  exporter: jaeger\n",
+			expErr:  "tracing.exporter",
+		},
+		"invalid platform": {
+			content: "apiVersion: imageclone.simontheleg.dev/v1alpha1\nkind: ControllerConfiguration\nplatforms: [amd64]\n",
+			expErr:  "platforms",
+		},
+		"invalid separator": {
+			content: "apiVersion: imageclone.simontheleg.dev/v1alpha1\nkind: ControllerConfiguration\nnaming:\n  separator: /\n",
+			expErr:  "naming.separator",
+		},
+		"invalid selector": {
+			content: "apiVersion: imageclone.simontheleg.dev/v1alpha1\nkind: ControllerConfiguration\nnamespaces:\n  selector: 'a=('\n",
+			expErr:  "namespaces.selector",
+		},
+		"negative concurrency": {
+			content: "apiVersion: imageclone.simontheleg.dev/v1alpha1\nkind: ControllerConfiguration\nconcurrency:\n  backups: -1\n",
+			expErr:  "concurrency.backups",
+		},
+		"base delay exceeds max delay": {
+			content: "apiVersion: imageclone.simontheleg.dev/v1alpha1\nkind: ControllerConfiguration\nreconcile:\n  rateLimiter:\n    baseDelay: 10m\n    maxDelay: 1m\n",
+			expErr:  "exceeds maxDelay",
+		},
+		"unknown mode": {
+			content: "apiVersion: imageclone.simontheleg.dev/v1alpha1\nkind: ControllerConfiguration\nmode: yolo\n",
+			expErr:  "unknown mode",
+		},
+	}
+
+	for name, tc := range tt {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			if err := ioutil.WriteFile(path, []byte(tc.content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			c, err := Load(path)
+			if tc.expErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.expErr) {
+					t.Errorf("Exp error containing '%s', got '%v'", tc.expErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Exp no error, got '%v'", err)
+			}
+			if c.BackupRegistry != "registry.example.com/backup/" || c.Naming.Separator != "--" || c.Concurrency.Backups != 8 {
+				t.Errorf("Unexpected config: %+v", c)
+			}
+			if len(c.Platforms) != 2 {
+				t.Errorf("Exp 2 platforms, got %v", c.Platforms)
+			}
+			if c.PartialRewrite == nil || !*c.PartialRewrite {
+				t.Error("Exp partialRewrite to be set")
+			}
+			if c.Reconcile.SyncPeriod == nil || c.Reconcile.SyncPeriod.Duration != time.Hour || c.Reconcile.MaxConcurrentReconciles.Deployments != 4 {
+				t.Errorf("Unexpected reconcile config: %+v", c.Reconcile)
+			}
+			if c.AuditCopy != nil {
+				t.Error("Exp auditCopy to be unset")
+			}
+		})
+	}
+}
+
+func TestValidSeparator(t *testing.T) {
+	tt := map[string]struct {
+		sep    string
+		expErr bool
+	}{
+		"default":         {sep: ""},
+		"underscore":      {sep: "_"},
+		"double":          {sep: "__"},
+		"dashes":          {sep: "---"},
+		"slash":           {sep: "/", expErr: true},
+		"colon":           {sep: ":", expErr: true},
+		"mixed":           {sep: "-_", expErr: true},
+		"upper case text": {sep: "X", expErr: true},
+	}
+
+	for name, tc := range tt {
+		t.Run(name, func(t *testing.T) {
+			if err := ValidSeparator(tc.sep); (err != nil) != tc.expErr {
+				t.Errorf("Exp error '%t', got '%v'", tc.expErr, err)
+			}
+		})
+	}
+}
+
+func TestWatch(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(path, []byte("a"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changed := make(chan struct{}, 10)
+	done := make(chan error)
+	go func() {
+		done <- Watch(ctx, path, func() { changed <- struct{}{} })
+	}()
+	// give the watcher time to start
+	time.Sleep(100 * time.Millisecond)
+
+	// changes to other files are ignored
+	if err := ioutil.WriteFile(filepath.Join(dir, "other.yaml"), []byte("b"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// files are replaced by renaming, like editors and ConfigMap volumes do
+	tmp := filepath.Join(dir, "config.yaml.tmp")
+	if err := ioutil.WriteFile(tmp, []byte("c"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-changed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("onChange was not called")
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("Exp no error, got '%v'", err)
+	}
+}
@@ -0,0 +1,54 @@
+package controller
+
+import (
+	"context"
+
+	"github.com/simontheleg/image-clone-controller/auditlog"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// audit records e in the audit log, if there is one, adding the workload of the BackUPer
+func (b *BackUPer) audit(ctx context.Context, e auditlog.Entry) {
+	recordAudit(ctx, b.AuditLog, b.Obj, e)
+}
+
+// containerRewrite is a container, as it was before being rewritten to its backup
+type containerRewrite struct {
+	container corev1.Container
+	bu        backup
+}
+
+// auditRewrites records the rewrites of the containers of obj to their backups in the audit log, if there is one.
+// In ModeAudit they are recorded as audited
+func (r *GenericReconciler) auditRewrites(ctx context.Context, obj runtime.Object, rws []containerRewrite) {
+	action := auditlog.ActionRewritten
+	if r.Mode == ModeAudit {
+		action = auditlog.ActionAudited
+	}
+	for _, rw := range rws {
+		recordAudit(ctx, r.AuditLog, obj, auditlog.Entry{
+			Action:       action,
+			Container:    rw.container.Name,
+			Source:       rw.container.Image,
+			SourceDigest: rw.bu.digest,
+			Backup:       rw.bu.ref,
+			BackupDigest: rw.bu.backupDigest,
+		})
+	}
+}
+
+// recordAudit adds the workload obj to e and records it in sink, if it is set. The audit log must not block backups,
+// so failing to record e is only logged
+func recordAudit(ctx context.Context, sink auditlog.Sink, obj runtime.Object, e auditlog.Entry) {
+	if sink == nil {
+		return
+	}
+	if ref, ok := workloadReference(obj); ok {
+		e.Kind, e.Namespace, e.Name = ref.Kind, ref.Namespace, ref.Name
+	}
+	if err := sink.Record(e); err != nil {
+		log.FromContext(ctx).Error(err, "Could not record audit log entry", "action", e.Action, "source", e.Source)
+	}
+}
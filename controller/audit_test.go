@@ -0,0 +1,86 @@
+package controller
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/simontheleg/image-clone-controller/auditlog"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+type mockSink struct {
+	mu      sync.Mutex
+	entries []auditlog.Entry
+}
+
+func (m *mockSink) Record(e auditlog.Entry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries = append(m.entries, e)
+	return nil
+}
+
+func TestAuditLog(t *testing.T) {
+	tt := map[string]struct {
+		mode       Mode
+		noWorkload bool
+		expActions []auditlog.Action
+	}{
+		"enforce": {
+			mode:       ModeEnforce,
+			expActions: []auditlog.Action{auditlog.ActionCopied, auditlog.ActionRewritten},
+		},
+		"audit": {
+			mode:       ModeAudit,
+			expActions: []auditlog.Action{auditlog.ActionAudited},
+		},
+		"failed patch": {
+			mode:       ModeEnforce,
+			noWorkload: true,
+			expActions: []auditlog.Action{auditlog.ActionCopied},
+		},
+	}
+
+	for name, tc := range tt {
+		t.Run(name, func(t *testing.T) {
+			sink := &mockSink{}
+			rec := &GenericReconciler{
+				RegClient:   &mockImgNotExistsReg{},
+				BuRegRemote: "test",
+				Mode:        tc.mode,
+				AuditLog:    sink,
+			}
+			dep := depFromImages([]string{"nginx:1.21"}, nil, "app", "test")
+			cb := fake.NewClientBuilder()
+			if !tc.noWorkload {
+				cb = cb.WithRuntimeObjects(dep.DeepCopy())
+			}
+			_, _, err := rec.rewriteWorkload(context.Background(), cb.Build(), dep, "Deployment")
+			if (err != nil) != tc.noWorkload {
+				t.Fatalf("Exp error '%t', got '%v'", tc.noWorkload, err)
+			}
+
+			if len(sink.entries) != len(tc.expActions) {
+				t.Fatalf("Exp %d entries, got %+v", len(tc.expActions), sink.entries)
+			}
+			for i, e := range sink.entries {
+				if e.Action != tc.expActions[i] {
+					t.Errorf("Exp action '%s', got '%s'", tc.expActions[i], e.Action)
+				}
+				if e.Kind != "Deployment" || e.Namespace != "test" || e.Name != "app" {
+					t.Errorf("Exp entry for Deployment test/app, got %+v", e)
+				}
+				if e.Backup != "index.docker.io/test/library_nginx:1.21" {
+					t.Errorf("Unexpected backup '%s'", e.Backup)
+				}
+				if tc.mode == ModeEnforce && (e.SourceDigest != mockDigest || e.BackupDigest != mockDigest) {
+					t.Errorf("Exp digests to be recorded, got %+v", e)
+				}
+			}
+			if last := sink.entries[len(sink.entries)-1]; last.Action != auditlog.ActionCopied && last.Container != "container-0" {
+				t.Errorf("Exp rewrite of container-0, got %+v", last)
+			}
+		})
+	}
+}
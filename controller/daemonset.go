@@ -3,48 +3,67 @@ package controller
 import (
 	"context"
 
+	"github.com/simontheleg/image-clone-controller/api/v1alpha1"
 	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 )
 
 type DaemonSetReconciler struct {
 	cl client.Client
 	GenericReconciler
+	// Concurrency and rate limiting of the reconciler
+	Controller ControllerOptions
 }
 
-func (r *DaemonSetReconciler) Reconcile(ctx context.Context, req reconcile.Request) (reconcile.Result, error) {
+func (r *DaemonSetReconciler) Reconcile(ctx context.Context, req reconcile.Request) (res reconcile.Result, err error) {
+	ctx, span := startReconcileSpan(ctx, "DaemonSet", req)
+	defer func() { endSpan(span, err) }()
 	log := log.FromContext(ctx)
 
 	log.Info("Reconciling DaemonSet", "deployment", req.NamespacedName)
 
-	dep := &appsv1.DaemonSet{}
-	err := r.cl.Get(ctx, req.NamespacedName, dep)
+	g := r.current()
+
+	watched, err := g.watchesNamespace(ctx, r.cl, req.Namespace)
 	if err != nil {
 		return reconcile.Result{}, err
 	}
-
-	patchReq, upd, err := r.GenericReconciler.patchPodSpecAndImage(ctx, dep.Spec.Template)
+	if !watched {
+		log.Info("Skipping workload in unwatched namespace", "deployment", req.NamespacedName)
+		return reconcile.Result{}, nil
+	}
+	g, err = g.policyFor(ctx, r.cl, req.Namespace)
 	if err != nil {
 		return reconcile.Result{}, err
 	}
 
-	newDep := dep
-	newDep.Spec.Template = *upd
+	dep := &appsv1.DaemonSet{}
+	err = r.cl.Get(ctx, req.NamespacedName, dep)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+	if skipWorkload(dep) {
+		log.Info("Skipping opted out workload", "deployment", req.NamespacedName)
+		return reconcile.Result{}, nil
+	}
 
-	if patchReq {
-		log.Info("Patch required", "deployment", req.NamespacedName)
-		err = r.cl.Update(ctx, newDep)
-		if err != nil {
-			return reconcile.Result{}, err
-		}
-	} else {
-		log.Info("No patch required", "deployment", req.NamespacedName)
+	_, buErr, err := g.rewriteWorkload(ctx, r.cl, dep, "DaemonSet")
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+	if buErr != nil {
+		return resultFromError(ctx, buErr)
 	}
 
-	return reconcile.Result{}, nil
+	return reconcile.Result{RequeueAfter: g.ResyncInterval}, nil
 }
 
 func (r *DaemonSetReconciler) InjectClient(c client.Client) error {
@@ -53,8 +72,49 @@ func (r *DaemonSetReconciler) InjectClient(c client.Client) error {
 }
 
 func (r *DaemonSetReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	return ctrl.NewControllerManagedBy(mgr).
-		For(&appsv1.DaemonSet{}).
-		WithEventFilter(contrPredicate(r.Igns)).
-		Complete(r)
+	b := ctrl.NewControllerManagedBy(mgr).
+		WithOptions(r.Controller.options()).
+		For(&appsv1.DaemonSet{}, builder.WithPredicates(contrPredicate(func() []string { return r.current().Igns })))
+	// with a live configuration, selectors may be set later on
+	if r.Live != nil || r.selectsNamespaces() {
+		b = b.Watches(
+			&source.Kind{Type: &corev1.Namespace{}},
+			handler.EnqueueRequestsFromMapFunc(r.mapNamespace),
+			builder.WithPredicates(namespaceLabelsPredicate()),
+		)
+	}
+	if r.Policies {
+		b = b.Watches(
+			&source.Kind{Type: &v1alpha1.ImageClonePolicy{}},
+			handler.EnqueueRequestsFromMapFunc(r.mapPolicy),
+			builder.WithPredicates(predicate.GenerationChangedPredicate{}),
+		).Watches(
+			&source.Kind{Type: &v1alpha1.ClusterImageClonePolicy{}},
+			handler.EnqueueRequestsFromMapFunc(r.mapPolicy),
+			builder.WithPredicates(predicate.GenerationChangedPredicate{}),
+		)
+	}
+	return b.Complete(r)
+}
+
+// mapNamespace enqueues all DaemonSets of a namespace
+func (r *DaemonSetReconciler) mapNamespace(ns client.Object) []reconcile.Request {
+	return r.requestsIn(ns.GetName())
+}
+
+// mapPolicy enqueues all DaemonSets a policy applies to. Cluster policies enqueue DaemonSets of all namespaces
+func (r *DaemonSetReconciler) mapPolicy(pol client.Object) []reconcile.Request {
+	return r.requestsIn(pol.GetNamespace())
+}
+
+// requestsIn returns requests for all DaemonSets in namespace, or of all namespaces if namespace is empty
+func (r *DaemonSetReconciler) requestsIn(namespace string) []reconcile.Request {
+	list := &appsv1.DaemonSetList{}
+	return namespaceRequests(context.Background(), r.cl, namespace, list, func() []client.Object {
+		objs := []client.Object{}
+		for i := range list.Items {
+			objs = append(objs, &list.Items[i])
+		}
+		return objs
+	})
 }
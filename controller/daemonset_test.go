@@ -2,6 +2,7 @@ package controller
 
 import (
 	"context"
+	"fmt"
 	"testing"
 
 	appsv1 "k8s.io/api/apps/v1"
@@ -116,12 +117,12 @@ func dsFromImages(images []string, initImages []string, name, namespace string)
 		},
 	}
 
-	for _, img := range images {
-		ret.Spec.Template.Spec.Containers = append(ret.Spec.Template.Spec.Containers, corev1.Container{Image: img})
+	for p, img := range images {
+		ret.Spec.Template.Spec.Containers = append(ret.Spec.Template.Spec.Containers, corev1.Container{Name: fmt.Sprintf("container-%d", p), Image: img})
 	}
 
-	for _, img := range initImages {
-		ret.Spec.Template.Spec.InitContainers = append(ret.Spec.Template.Spec.InitContainers, corev1.Container{Image: img})
+	for p, img := range initImages {
+		ret.Spec.Template.Spec.InitContainers = append(ret.Spec.Template.Spec.InitContainers, corev1.Container{Name: fmt.Sprintf("init-%d", p), Image: img})
 	}
 
 	return ret
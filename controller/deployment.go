@@ -3,48 +3,67 @@ package controller
 import (
 	"context"
 
+	"github.com/simontheleg/image-clone-controller/api/v1alpha1"
 	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 )
 
 type DeploymentReconciler struct {
 	cl client.Client
 	GenericReconciler
+	// Concurrency and rate limiting of the reconciler
+	Controller ControllerOptions
 }
 
-func (r *DeploymentReconciler) Reconcile(ctx context.Context, req reconcile.Request) (reconcile.Result, error) {
+func (r *DeploymentReconciler) Reconcile(ctx context.Context, req reconcile.Request) (res reconcile.Result, err error) {
+	ctx, span := startReconcileSpan(ctx, "Deployment", req)
+	defer func() { endSpan(span, err) }()
 	log := log.FromContext(ctx)
 
 	log.Info("Reconciling Deployment", "deployment", req.NamespacedName)
 
-	dep := &appsv1.Deployment{}
-	err := r.cl.Get(ctx, req.NamespacedName, dep)
+	g := r.current()
+
+	watched, err := g.watchesNamespace(ctx, r.cl, req.Namespace)
 	if err != nil {
 		return reconcile.Result{}, err
 	}
-
-	patchReq, upd, err := r.GenericReconciler.patchPodSpecAndImage(ctx, dep.Spec.Template)
+	if !watched {
+		log.Info("Skipping workload in unwatched namespace", "deployment", req.NamespacedName)
+		return reconcile.Result{}, nil
+	}
+	g, err = g.policyFor(ctx, r.cl, req.Namespace)
 	if err != nil {
 		return reconcile.Result{}, err
 	}
 
-	newDep := dep
-	newDep.Spec.Template = *upd
+	dep := &appsv1.Deployment{}
+	err = r.cl.Get(ctx, req.NamespacedName, dep)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+	if skipWorkload(dep) {
+		log.Info("Skipping opted out workload", "deployment", req.NamespacedName)
+		return reconcile.Result{}, nil
+	}
 
-	if patchReq {
-		log.Info("Patch required", "deployment", req.NamespacedName)
-		err = r.cl.Update(ctx, newDep)
-		if err != nil {
-			return reconcile.Result{}, err
-		}
-	} else {
-		log.Info("No patch required", "deployment", req.NamespacedName)
+	_, buErr, err := g.rewriteWorkload(ctx, r.cl, dep, "Deployment")
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+	if buErr != nil {
+		return resultFromError(ctx, buErr)
 	}
 
-	return reconcile.Result{}, nil
+	return reconcile.Result{RequeueAfter: g.ResyncInterval}, nil
 }
 
 func (r *DeploymentReconciler) InjectClient(c client.Client) error {
@@ -53,8 +72,49 @@ func (r *DeploymentReconciler) InjectClient(c client.Client) error {
 }
 
 func (r *DeploymentReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	return ctrl.NewControllerManagedBy(mgr).
-		For(&appsv1.Deployment{}).
-		WithEventFilter(contrPredicate(r.Igns)).
-		Complete(r)
+	b := ctrl.NewControllerManagedBy(mgr).
+		WithOptions(r.Controller.options()).
+		For(&appsv1.Deployment{}, builder.WithPredicates(contrPredicate(func() []string { return r.current().Igns })))
+	// with a live configuration, selectors may be set later on
+	if r.Live != nil || r.selectsNamespaces() {
+		b = b.Watches(
+			&source.Kind{Type: &corev1.Namespace{}},
+			handler.EnqueueRequestsFromMapFunc(r.mapNamespace),
+			builder.WithPredicates(namespaceLabelsPredicate()),
+		)
+	}
+	if r.Policies {
+		b = b.Watches(
+			&source.Kind{Type: &v1alpha1.ImageClonePolicy{}},
+			handler.EnqueueRequestsFromMapFunc(r.mapPolicy),
+			builder.WithPredicates(predicate.GenerationChangedPredicate{}),
+		).Watches(
+			&source.Kind{Type: &v1alpha1.ClusterImageClonePolicy{}},
+			handler.EnqueueRequestsFromMapFunc(r.mapPolicy),
+			builder.WithPredicates(predicate.GenerationChangedPredicate{}),
+		)
+	}
+	return b.Complete(r)
+}
+
+// mapNamespace enqueues all Deployments of a namespace
+func (r *DeploymentReconciler) mapNamespace(ns client.Object) []reconcile.Request {
+	return r.requestsIn(ns.GetName())
+}
+
+// mapPolicy enqueues all Deployments a policy applies to. Cluster policies enqueue Deployments of all namespaces
+func (r *DeploymentReconciler) mapPolicy(pol client.Object) []reconcile.Request {
+	return r.requestsIn(pol.GetNamespace())
+}
+
+// requestsIn returns requests for all Deployments in namespace, or of all namespaces if namespace is empty
+func (r *DeploymentReconciler) requestsIn(namespace string) []reconcile.Request {
+	list := &appsv1.DeploymentList{}
+	return namespaceRequests(context.Background(), r.cl, namespace, list, func() []client.Object {
+		objs := []client.Object{}
+		for i := range list.Items {
+			objs = append(objs, &list.Items[i])
+		}
+		return objs
+	})
 }
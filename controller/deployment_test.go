@@ -2,12 +2,15 @@ package controller
 
 import (
 	"context"
+	"fmt"
+	"strings"
 	"testing"
 
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	"sigs.k8s.io/controller-runtime/pkg/client/fake"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 )
@@ -21,6 +24,7 @@ func TestDeploymentController(t *testing.T) {
 		buReg       string
 		expImgs     []string
 		expInitImgs []string
+		expRewrite  bool
 	}{
 		"should update": {
 			name:        "test",
@@ -30,6 +34,7 @@ func TestDeploymentController(t *testing.T) {
 			buReg:       "test",
 			expImgs:     []string{"index.docker.io/test/simontheleg_debug-pod:latest"},
 			expInitImgs: []string{},
+			expRewrite:  true,
 		},
 		"nothing to update": {
 			name:        "test",
@@ -48,11 +53,13 @@ func TestDeploymentController(t *testing.T) {
 
 			c := fake.NewClientBuilder().WithRuntimeObjects(dep).Build()
 
+			recorder := record.NewFakeRecorder(10)
 			rec := &DeploymentReconciler{
 				cl: c,
 				GenericReconciler: GenericReconciler{
 					RegClient:   &mockImgExistsReg{},
 					BuRegRemote: tc.buReg,
+					Recorder:    recorder,
 				},
 			}
 
@@ -97,6 +104,133 @@ func TestDeploymentController(t *testing.T) {
 				}
 			}
 
+			if _, ok := gotDep.Annotations[originalImagesAnnotation]; ok != tc.expRewrite {
+				t.Errorf("Original images annotation on deployment: exp '%t', got '%t'", tc.expRewrite, ok)
+			}
+			if _, ok := gotDep.Spec.Template.Annotations[originalImagesAnnotation]; ok != tc.expRewrite {
+				t.Errorf("Original images annotation on pod template: exp '%t', got '%t'", tc.expRewrite, ok)
+			}
+
+			close(recorder.Events)
+			gotRewrite := false
+			for e := range recorder.Events {
+				if strings.HasPrefix(e, "Normal Rewritten") {
+					gotRewrite = true
+				}
+			}
+			if gotRewrite != tc.expRewrite {
+				t.Errorf("Rewritten event: exp '%t', got '%t'", tc.expRewrite, gotRewrite)
+			}
+		})
+	}
+}
+
+func TestDeploymentControllerPartialRewrite(t *testing.T) {
+	dep := depFromImages([]string{"img-a:1", "img-b:1"}, []string{}, "test", "test")
+	c := fake.NewClientBuilder().WithRuntimeObjects(dep).Build()
+
+	reg := &mockSlowReg{failImage: "index.docker.io/library/img-b:1"}
+	rec := &DeploymentReconciler{
+		cl: c,
+		GenericReconciler: GenericReconciler{
+			RegClient:      reg,
+			BuRegRemote:    "test",
+			PartialRewrite: true,
+		},
+	}
+	req := reconcile.Request{NamespacedName: types.NamespacedName{Name: "test", Namespace: "test"}}
+
+	// img-b cannot be found, which is a permanent error and therefore not retried
+	_, err := rec.Reconcile(context.Background(), req)
+	if err != nil {
+		t.Errorf("Error: exp nil, got '%s'", err)
+	}
+
+	gotDep := &appsv1.Deployment{}
+	if err := c.Get(context.Background(), req.NamespacedName, gotDep); err != nil {
+		t.Fatalf("could not get deployment: '%v'", err)
+	}
+	if got := gotDep.Spec.Template.Spec.Containers[0].Image; got != "index.docker.io/test/library_img-a:1" {
+		t.Errorf("Containers: Exp image 'index.docker.io/test/library_img-a:1', got '%s'", got)
+	}
+	if got := gotDep.Spec.Template.Spec.Containers[1].Image; got != "img-b:1" {
+		t.Errorf("Containers: Exp image 'img-b:1', got '%s'", got)
+	}
+	if _, ok := gotDep.Annotations[backupErrorsAnnotation]; !ok {
+		t.Error("Exp backup errors to be recorded on deployment")
+	}
+
+	// once the image is available, the annotation is removed again
+	reg.failImage = ""
+	if _, err := rec.Reconcile(context.Background(), req); err != nil {
+		t.Errorf("Error: exp nil, got '%s'", err)
+	}
+	gotDep = &appsv1.Deployment{}
+	if err := c.Get(context.Background(), req.NamespacedName, gotDep); err != nil {
+		t.Fatalf("could not get deployment: '%v'", err)
+	}
+	if _, ok := gotDep.Annotations[backupErrorsAnnotation]; ok {
+		t.Error("Exp backup errors to be removed from deployment")
+	}
+}
+
+func TestDeploymentControllerAudit(t *testing.T) {
+	tt := map[string]struct {
+		auditCopy  bool
+		expBIcalls int
+	}{
+		"audit without copy": {
+			auditCopy:  false,
+			expBIcalls: 0,
+		},
+		"audit with copy": {
+			auditCopy:  true,
+			expBIcalls: 1,
+		},
+	}
+
+	for name, tc := range tt {
+		t.Run(name, func(t *testing.T) {
+			dep := depFromImages([]string{"simontheleg/debug-pod:latest"}, []string{}, "test", "test")
+			c := fake.NewClientBuilder().WithRuntimeObjects(dep).Build()
+
+			reg := &mockImgNotExistsReg{}
+			recorder := record.NewFakeRecorder(10)
+			rec := &DeploymentReconciler{
+				cl: c,
+				GenericReconciler: GenericReconciler{
+					RegClient:   reg,
+					BuRegRemote: "test",
+					Mode:        ModeAudit,
+					AuditCopy:   tc.auditCopy,
+					Recorder:    recorder,
+				},
+			}
+			req := reconcile.Request{NamespacedName: types.NamespacedName{Name: "test", Namespace: "test"}}
+
+			if _, err := rec.Reconcile(context.Background(), req); err != nil {
+				t.Errorf("Error: exp nil, got '%s'", err)
+			}
+
+			gotDep := &appsv1.Deployment{}
+			if err := c.Get(context.Background(), req.NamespacedName, gotDep); err != nil {
+				t.Fatalf("could not get deployment: '%v'", err)
+			}
+			if got := gotDep.Spec.Template.Spec.Containers[0].Image; got != "simontheleg/debug-pod:latest" {
+				t.Errorf("Containers: Exp image to stay 'simontheleg/debug-pod:latest', got '%s'", got)
+			}
+			if reg.backUpImageCalled != tc.expBIcalls {
+				t.Errorf("BackUpImageCalled: Want '%d', got '%d'", tc.expBIcalls, reg.backUpImageCalled)
+			}
+
+			select {
+			case e := <-recorder.Events:
+				if !strings.Contains(e, "index.docker.io/test/simontheleg_debug-pod:latest") {
+					t.Errorf("Exp event to contain the would-be image, got '%s'", e)
+				}
+			default:
+				t.Error("Exp an audit event to be recorded")
+			}
 		})
 	}
 }
@@ -116,12 +250,12 @@ func depFromImages(images []string, initImages []string, name, namespace string)
 		},
 	}
 
-	for _, img := range images {
-		ret.Spec.Template.Spec.Containers = append(ret.Spec.Template.Spec.Containers, corev1.Container{Image: img})
+	for p, img := range images {
+		ret.Spec.Template.Spec.Containers = append(ret.Spec.Template.Spec.Containers, corev1.Container{Name: fmt.Sprintf("container-%d", p), Image: img})
 	}
 
-	for _, img := range initImages {
-		ret.Spec.Template.Spec.InitContainers = append(ret.Spec.Template.Spec.InitContainers, corev1.Container{Image: img})
+	for p, img := range initImages {
+		ret.Spec.Template.Spec.InitContainers = append(ret.Spec.Template.Spec.InitContainers, corev1.Container{Name: fmt.Sprintf("init-%d", p), Image: img})
 	}
 
 	return ret
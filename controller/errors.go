@@ -0,0 +1,58 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// backupErrorsAnnotation is set on workloads for which some images could not be backed up
+const backupErrorsAnnotation = "image-clone-controller/backup-errors"
+
+// ContainerError is the error of backing up the image of a single container
+type ContainerError struct {
+	Container string
+	Image     string
+	Err       error
+}
+
+func (e ContainerError) Error() string {
+	return fmt.Sprintf("container '%s' (%s): %v", e.Container, e.Image, e.Err)
+}
+
+func (e ContainerError) Unwrap() error {
+	return e.Err
+}
+
+// BackupErrors aggregates the errors of all containers whose images could not be backed up
+type BackupErrors []ContainerError
+
+func (e BackupErrors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, ce := range e {
+		msgs = append(msgs, ce.Error())
+	}
+	return fmt.Sprintf("backup failed for %d container(s): %s", len(e), strings.Join(msgs, "; "))
+}
+
+// Is reports whether any of the aggregated errors matches target
+func (e BackupErrors) Is(target error) bool {
+	for _, ce := range e {
+		if errors.Is(ce.Err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// recordBackupErrors stores aggregated backup errors as an annotation on the workload, or removes the
+// annotation once there are none left. It returns whether the annotations have changed
+func recordBackupErrors(obj metav1.Object, err error) bool {
+	var buErrs BackupErrors
+	if !errors.As(err, &buErrs) {
+		return setAnnotation(obj, backupErrorsAnnotation, "")
+	}
+	return setAnnotation(obj, backupErrorsAnnotation, buErrs.Error())
+}
@@ -0,0 +1,358 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/simontheleg/image-clone-controller/api/v1alpha1"
+	"github.com/simontheleg/image-clone-controller/registry"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// GCOptions configure the garbage collection of backups
+type GCOptions struct {
+	// How long a backup must be unreferenced before it is deleted
+	GracePeriod time.Duration
+	// Number of most recent backups per repository which are never deleted
+	KeepLast int
+	// Only report which backups would be deleted without modifying the registry or the inventory
+	DryRun bool
+}
+
+// GCResult describes the outcome of the garbage collection for a single backup
+type GCResult struct {
+	Backup string
+	// Whether the backup was deleted, or would have been in a dry run
+	Delete bool
+	// Why the backup was kept or deleted
+	Reason string
+	Err    error
+}
+
+// CollectGarbage deletes backups recorded as ImageBackups, which have not been referenced by any workload for at least
+// GracePeriod. Deployments, DaemonSets, ReplicaSets and Pods in all namespaces count as references, so images still in use
+// or kept for rollbacks are never deleted, even in namespaces the controller does not watch.
+// The KeepLast most recent backups of each repository are always kept. Backups are deleted by digest, so a backup sharing
+// its digest with a backup which is kept, is kept as well. Backups without an ImageBackup are never deleted.
+// The workloads and UnreferencedSince of each ImageBackup are updated along the way. Backups verified by the controller
+// after the garbage collection started may have been referenced since and are never deleted.
+// reader is used to list workloads and may be uncached to avoid caching all Pods and ReplicaSets of the cluster
+func CollectGarbage(ctx context.Context, cl client.Client, reader client.Reader, reg registry.BackUp, auth authn.Authenticator, opts GCOptions) ([]GCResult, error) {
+	now := metav1.Now()
+	refs, err := referencedImages(ctx, reader)
+	if err != nil {
+		return nil, err
+	}
+	ibs := &v1alpha1.ImageBackupList{}
+	if err := cl.List(ctx, ibs); err != nil {
+		return nil, err
+	}
+
+	res := make([]GCResult, len(ibs.Items))
+	referenced := make([]bool, len(ibs.Items))
+	repos := map[string][]int{}
+	for i := range ibs.Items {
+		ib := &ibs.Items[i]
+		res[i].Backup = ib.Spec.Backup
+		buRef, err := name.ParseReference(ib.Spec.Backup)
+		if err != nil {
+			res[i].Reason, res[i].Err = "invalid backup reference", err
+			continue
+		}
+
+		wls, ok := backupReferences(refs, ib, buRef)
+		if opts.DryRun {
+			setReferences(ib, wls, ok, now)
+		} else if err := updateReferences(ctx, cl, ib, wls, ok, now); err != nil {
+			// whether the backup is referenced is unknown, so it is kept and counts towards KeepLast
+			res[i].Reason, res[i].Err = "could not update inventory", err
+		}
+		referenced[i] = res[i].Err != nil || !unreferenced(ib, now)
+		if referenced[i] && res[i].Err == nil {
+			res[i].Reason = "referenced"
+		}
+		repos[buRef.Context().Name()] = append(repos[buRef.Context().Name()], i)
+	}
+
+	// digests of backups which are kept, as deleting a digest removes all of its tags
+	kept := map[string]bool{}
+	for _, idxs := range repos {
+		sort.Slice(idxs, func(a, b int) bool {
+			return ibs.Items[idxs[b]].Status.FirstVerified.Before(&ibs.Items[idxs[a]].Status.FirstVerified)
+		})
+		for n, i := range idxs {
+			ib := &ibs.Items[i]
+			switch {
+			case referenced[i]:
+			case n < opts.KeepLast:
+				res[i].Reason = fmt.Sprintf("one of the last %d backups of the repository", opts.KeepLast)
+			case now.Sub(ib.Status.UnreferencedSince.Time) < opts.GracePeriod:
+				res[i].Reason = fmt.Sprintf("unreferenced since %s, within the grace period", ib.Status.UnreferencedSince.Format(time.RFC3339))
+			default:
+				res[i].Delete = true
+				continue
+			}
+			kept[digestReference(ib)] = true
+		}
+	}
+
+	// the controller may have rewritten a workload to a backup since it was listed
+	if !opts.DryRun {
+		for i := range ibs.Items {
+			if !res[i].Delete {
+				continue
+			}
+			cur := &v1alpha1.ImageBackup{}
+			err := cl.Get(ctx, client.ObjectKeyFromObject(&ibs.Items[i]), cur)
+			switch {
+			case err != nil:
+				res[i].Reason, res[i].Err = "could not verify the backup is still unreferenced", client.IgnoreNotFound(err)
+			case !unreferenced(cur, now):
+				res[i].Reason = "referenced during the garbage collection"
+			default:
+				continue
+			}
+			res[i].Delete = false
+			kept[digestReference(&ibs.Items[i])] = true
+		}
+	}
+
+	deleted := map[string]error{}
+	for i := range ibs.Items {
+		if !res[i].Delete {
+			continue
+		}
+		ib := &ibs.Items[i]
+		dRef := digestReference(ib)
+		if kept[dRef] {
+			res[i].Delete = false
+			res[i].Reason = "shares its digest with a backup which is kept"
+			continue
+		}
+		res[i].Reason = fmt.Sprintf("unreferenced since %s", ib.Status.UnreferencedSince.Format(time.RFC3339))
+		if opts.DryRun {
+			continue
+		}
+
+		err, done := deleted[dRef]
+		if !done {
+			err = deleteManifest(ctx, reg, dRef, auth)
+			deleted[dRef] = err
+			if err == nil {
+				gcDeletedTotal.Inc()
+			}
+		}
+		if err == nil {
+			err = client.IgnoreNotFound(cl.Delete(ctx, ib))
+		}
+		res[i].Err = err
+	}
+
+	sort.Slice(res, func(a, b int) bool { return res[a].Backup < res[b].Backup })
+	return res, nil
+}
+
+// backupReferences returns the workloads referencing the backup of ib by tag, or by digest, which is how backups of
+// digest references are used
+func backupReferences(refs map[string][]v1alpha1.WorkloadReference, ib *v1alpha1.ImageBackup, buRef name.Reference) ([]v1alpha1.WorkloadReference, bool) {
+	wls, ok := refs[buRef.Name()]
+	dRef := digestReference(ib)
+	if dRef == buRef.Name() {
+		return wls, ok
+	}
+	pinned, pinnedOk := refs[dRef]
+	var merged []v1alpha1.WorkloadReference
+	merged = append(merged, wls...)
+	for _, wl := range pinned {
+		found := false
+		for _, w := range wls {
+			if w == wl {
+				found = true
+				break
+			}
+		}
+		if !found {
+			merged = append(merged, wl)
+		}
+	}
+	return merged, ok || pinnedOk
+}
+
+// setReferences sets the workloads and UnreferencedSince of ib as observed at start. Backups verified by the controller
+// since are left untouched, as the workloads referencing them may not have been observed
+func setReferences(ib *v1alpha1.ImageBackup, wls []v1alpha1.WorkloadReference, referenced bool, start metav1.Time) {
+	if verifiedSince(ib, start.Time) {
+		return
+	}
+	ib.Status.Workloads = wls
+	if referenced {
+		ib.Status.UnreferencedSince = nil
+	} else if ib.Status.UnreferencedSince == nil {
+		ib.Status.UnreferencedSince = &start
+	}
+}
+
+// updateReferences sets the references of ib and updates it, retrying on concurrent updates by the controller
+func updateReferences(ctx context.Context, cl client.Client, ib *v1alpha1.ImageBackup, wls []v1alpha1.WorkloadReference, referenced bool, start metav1.Time) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		old := ib.DeepCopy()
+		setReferences(ib, wls, referenced, start)
+		if equality.Semantic.DeepEqual(old, ib) {
+			return nil
+		}
+		err := cl.Update(ctx, ib)
+		if apierrors.IsConflict(err) {
+			if err := cl.Get(ctx, client.ObjectKeyFromObject(ib), ib); err != nil {
+				return err
+			}
+		}
+		return err
+	})
+}
+
+// unreferenced returns whether ib is unreferenced and has not been verified by the controller since, nor since start
+func unreferenced(ib *v1alpha1.ImageBackup, start metav1.Time) bool {
+	return ib.Status.UnreferencedSince != nil && !verifiedSince(ib, ib.Status.UnreferencedSince.Time) && !verifiedSince(ib, start.Time)
+}
+
+// verifiedSince returns whether ib was verified at or after t. LastVerified only has a precision of seconds
+func verifiedSince(ib *v1alpha1.ImageBackup, t time.Time) bool {
+	return !ib.Status.LastVerified.Time.Before(t.Truncate(time.Second))
+}
+
+// digestReference returns the reference of the manifest recorded by ib. Backups without a digest are referenced by tag
+func digestReference(ib *v1alpha1.ImageBackup) string {
+	buRef, err := name.ParseReference(ib.Spec.Backup)
+	if err != nil || ib.Status.BackupDigest == "" {
+		return ib.Spec.Backup
+	}
+	return buRef.Context().Digest(ib.Status.BackupDigest).Name()
+}
+
+// deleteManifest deletes the manifest ref points to. Manifests which are already gone count as deleted
+func deleteManifest(ctx context.Context, reg registry.BackUp, ref string, auth authn.Authenticator) error {
+	r, err := name.ParseReference(ref)
+	if err != nil {
+		return err
+	}
+	err = reg.Delete(ctx, r, remote.WithAuth(auth))
+	if errors.Is(err, registry.ErrNotFound) || errors.Is(err, registry.ErrManifestUnknown) {
+		return nil
+	}
+	return err
+}
+
+// referencedImages returns the normalized names of all images used by Deployments, DaemonSets, ReplicaSets and Pods,
+// together with the Deployments and DaemonSets using them. Digest references are keyed by repository and digest
+func referencedImages(ctx context.Context, reader client.Reader) (map[string][]v1alpha1.WorkloadReference, error) {
+	refs := map[string][]v1alpha1.WorkloadReference{}
+	add := func(pts *corev1.PodSpec, wl *v1alpha1.WorkloadReference) {
+		for _, conts := range [][]corev1.Container{pts.InitContainers, pts.Containers} {
+			for _, cont := range conts {
+				ref, err := name.ParseReference(cont.Image)
+				if err != nil {
+					continue
+				}
+				wls := refs[ref.Name()]
+				if wl != nil && (len(wls) == 0 || wls[len(wls)-1] != *wl) {
+					wls = append(wls, *wl)
+				}
+				refs[ref.Name()] = wls
+			}
+		}
+	}
+
+	deps := &appsv1.DeploymentList{}
+	if err := reader.List(ctx, deps); err != nil {
+		return nil, err
+	}
+	for i := range deps.Items {
+		wl, _ := workloadReference(&deps.Items[i])
+		add(&deps.Items[i].Spec.Template.Spec, &wl)
+	}
+	dss := &appsv1.DaemonSetList{}
+	if err := reader.List(ctx, dss); err != nil {
+		return nil, err
+	}
+	for i := range dss.Items {
+		wl, _ := workloadReference(&dss.Items[i])
+		add(&dss.Items[i].Spec.Template.Spec, &wl)
+	}
+	rss := &appsv1.ReplicaSetList{}
+	if err := reader.List(ctx, rss); err != nil {
+		return nil, err
+	}
+	for i := range rss.Items {
+		add(&rss.Items[i].Spec.Template.Spec, nil)
+	}
+	pods := &corev1.PodList{}
+	if err := reader.List(ctx, pods); err != nil {
+		return nil, err
+	}
+	for i := range pods.Items {
+		add(&pods.Items[i].Spec, nil)
+	}
+	return refs, nil
+}
+
+// GarbageCollector periodically runs CollectGarbage with the registry and credentials of the current configuration.
+// It only runs on the leader
+type GarbageCollector struct {
+	GenericReconciler
+	Client client.Client
+	// Used to list workloads, see CollectGarbage
+	APIReader client.Reader
+	Interval  time.Duration
+	Options   GCOptions
+}
+
+func (gc *GarbageCollector) Start(ctx context.Context) error {
+	log := log.FromContext(ctx).WithName("gc")
+	t := time.NewTicker(gc.Interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-t.C:
+		}
+
+		g := gc.current()
+		res, err := CollectGarbage(ctx, gc.Client, gc.APIReader, g.RegClient, g.DAuth, gc.Options)
+		if err != nil {
+			log.Error(err, "Garbage collection failed")
+			continue
+		}
+		deleted := 0
+		for _, r := range res {
+			switch {
+			case r.Err != nil:
+				log.Error(r.Err, "Could not collect backup", "backup", r.Backup, "reason", r.Reason)
+			case r.Delete && gc.Options.DryRun:
+				log.Info("Would delete backup", "backup", r.Backup, "reason", r.Reason)
+			case r.Delete:
+				deleted++
+				log.Info("Deleted backup", "backup", r.Backup, "reason", r.Reason)
+			}
+		}
+		log.Info("Garbage collection finished", "backups", len(res), "deleted", deleted, "dryRun", gc.Options.DryRun)
+	}
+}
+
+// NeedLeaderElection ensures only a single replica deletes backups
+func (gc *GarbageCollector) NeedLeaderElection() bool {
+	return true
+}
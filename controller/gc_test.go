@@ -0,0 +1,300 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/simontheleg/image-clone-controller/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// mockDeleteReg records all deleted references
+type mockDeleteReg struct {
+	mockImgExistsReg
+	dmu     sync.Mutex
+	deleted []string
+}
+
+func (m *mockDeleteReg) Delete(ctx context.Context, ref name.Reference, opts ...remote.Option) error {
+	m.dmu.Lock()
+	defer m.dmu.Unlock()
+	m.deleted = append(m.deleted, ref.Name())
+	return nil
+}
+
+// racingClient runs onList once after ImageBackups have been listed
+type racingClient struct {
+	client.Client
+	onList func()
+}
+
+func (c *racingClient) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	err := c.Client.List(ctx, list, opts...)
+	if _, ok := list.(*v1alpha1.ImageBackupList); ok && c.onList != nil {
+		c.onList()
+		c.onList = nil
+	}
+	return err
+}
+
+// failingUpdateClient fails to update the object named fail
+type failingUpdateClient struct {
+	client.Client
+	fail string
+}
+
+func (c *failingUpdateClient) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	if obj.GetName() == c.fail {
+		return errors.New("update failed")
+	}
+	return c.Client.Update(ctx, obj, opts...)
+}
+
+func TestCollectGarbage(t *testing.T) {
+	digest := func(c byte) string {
+		d := []byte("sha256:0000000000000000000000000000000000000000000000000000000000000000")
+		d[len(d)-1] = c
+		return string(d)
+	}
+	now := time.Now()
+	ago := func(d time.Duration) *metav1.Time {
+		t := metav1.NewTime(now.Add(-d))
+		return &t
+	}
+	ib := func(backup, dig string, created time.Duration, unrefSince *metav1.Time) *v1alpha1.ImageBackup {
+		return &v1alpha1.ImageBackup{
+			ObjectMeta: metav1.ObjectMeta{Name: ImageBackupName(backup)},
+			Spec:       v1alpha1.ImageBackupSpec{Source: "src", Backup: backup},
+			Status: v1alpha1.ImageBackupStatus{
+				BackupDigest:      dig,
+				FirstVerified:     *ago(created),
+				UnreferencedSince: unrefSince,
+			},
+		}
+	}
+	objs := func() []runtime.Object {
+		return []runtime.Object{
+			depFromImages([]string{"backup.example.com/b/used:1", "backup.example.com/b/old:2"}, nil, "dep", "test"),
+			// referenced by a deployment
+			ib("backup.example.com/b/used:1", digest('1'), 30*24*time.Hour, ago(time.Hour)),
+			// just became unreferenced
+			ib("backup.example.com/b/new:1", digest('2'), 30*24*time.Hour, nil),
+			// unreferenced for longer than the grace period
+			ib("backup.example.com/b/old:1", digest('3'), 30*24*time.Hour, ago(10*24*time.Hour)),
+			ib("backup.example.com/b/old:2", digest('6'), 24*time.Hour, nil),
+			// the newest backup of the repository is kept
+			ib("backup.example.com/b/repo:2", digest('4'), 20*24*time.Hour, ago(10*24*time.Hour)),
+			ib("backup.example.com/b/repo:1", digest('5'), 25*24*time.Hour, ago(10*24*time.Hour)),
+			// shares its digest with repo:2
+			ib("backup.example.com/b/repo:3", digest('4'), 30*24*time.Hour, ago(10*24*time.Hour)),
+		}
+	}
+	opts := GCOptions{GracePeriod: 7 * 24 * time.Hour, KeepLast: 1}
+
+	t.Run("dry run", func(t *testing.T) {
+		c := fake.NewClientBuilder().WithScheme(policyScheme(t)).WithRuntimeObjects(objs()...).Build()
+		reg := &mockDeleteReg{}
+		dry := opts
+		dry.DryRun = true
+
+		res, err := CollectGarbage(context.Background(), c, c, reg, nil, dry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		del := map[string]bool{}
+		for _, r := range res {
+			del[r.Backup] = r.Delete
+		}
+		exp := map[string]bool{
+			"backup.example.com/b/used:1": false,
+			"backup.example.com/b/new:1":  false,
+			"backup.example.com/b/old:1":  true,
+			"backup.example.com/b/old:2":  false,
+			"backup.example.com/b/repo:2": false,
+			"backup.example.com/b/repo:1": true,
+			"backup.example.com/b/repo:3": false,
+		}
+		for b, e := range exp {
+			if del[b] != e {
+				t.Errorf("%s: exp delete '%t', got '%t'", b, e, del[b])
+			}
+		}
+		if len(reg.deleted) != 0 {
+			t.Errorf("Exp no deletes in dry run, got '%v'", reg.deleted)
+		}
+		got := &v1alpha1.ImageBackup{}
+		if err := c.Get(context.Background(), types.NamespacedName{Name: ImageBackupName("backup.example.com/b/new:1")}, got); err != nil {
+			t.Fatal(err)
+		}
+		if got.Status.UnreferencedSince != nil {
+			t.Error("Exp inventory to be untouched in dry run")
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		c := fake.NewClientBuilder().WithScheme(policyScheme(t)).WithRuntimeObjects(objs()...).Build()
+		reg := &mockDeleteReg{}
+
+		if _, err := CollectGarbage(context.Background(), c, c, reg, nil, opts); err != nil {
+			t.Fatal(err)
+		}
+
+		expDeleted := map[string]bool{
+			"backup.example.com/b/old@" + digest('3'):  true,
+			"backup.example.com/b/repo@" + digest('5'): true,
+		}
+		if len(reg.deleted) != len(expDeleted) {
+			t.Errorf("Exp %d deletes, got '%v'", len(expDeleted), reg.deleted)
+		}
+		for _, d := range reg.deleted {
+			if !expDeleted[d] {
+				t.Errorf("Unexpected delete of '%s'", d)
+			}
+		}
+
+		get := func(backup string) (*v1alpha1.ImageBackup, error) {
+			got := &v1alpha1.ImageBackup{}
+			return got, c.Get(context.Background(), types.NamespacedName{Name: ImageBackupName(backup)}, got)
+		}
+		if _, err := get("backup.example.com/b/old:1"); !apierrors.IsNotFound(err) {
+			t.Errorf("Exp ImageBackup of deleted backup to be removed, got '%v'", err)
+		}
+		used, err := get("backup.example.com/b/used:1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if used.Status.UnreferencedSince != nil || len(used.Status.Workloads) != 1 || used.Status.Workloads[0].Name != "dep" {
+			t.Errorf("Exp referenced backup to list its workload, got %+v", used.Status)
+		}
+		unref, err := get("backup.example.com/b/new:1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if unref.Status.UnreferencedSince == nil {
+			t.Error("Exp unreferenced backup to be tracked")
+		}
+	})
+
+	t.Run("backups referenced during the garbage collection are kept", func(t *testing.T) {
+		c := &racingClient{Client: fake.NewClientBuilder().WithScheme(policyScheme(t)).WithRuntimeObjects(objs()...).Build()}
+		reg := &mockDeleteReg{}
+		// the controller rewrites a workload to the backups after they were listed. The GC deletes old:1 and updates new:1
+		backups := map[string]string{"backup.example.com/b/old:1": digest('3'), "backup.example.com/b/new:1": digest('2')}
+		c.onList = func() {
+			bu := &BackUPer{Reg: reg, Inventory: c.Client, Obj: dsFromImages(nil, nil, "ds", "test")}
+			for backup, dig := range backups {
+				buRef, _ := name.ParseReference(backup)
+				if err := bu.recordBackup(context.Background(), buRef, buRef, "", dig, false); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+
+		res, err := CollectGarbage(context.Background(), c, c, reg, nil, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, r := range res {
+			if _, ok := backups[r.Backup]; ok && (r.Delete || r.Err != nil) {
+				t.Errorf("Exp backup to be kept, got %+v", r)
+			}
+		}
+		for _, d := range reg.deleted {
+			if d == "backup.example.com/b/old@"+digest('3') {
+				t.Errorf("Unexpected delete of '%s'", d)
+			}
+		}
+
+		for backup := range backups {
+			got := &v1alpha1.ImageBackup{}
+			if err := c.Get(context.Background(), types.NamespacedName{Name: ImageBackupName(backup)}, got); err != nil {
+				t.Fatal(err)
+			}
+			if got.Status.UnreferencedSince != nil || len(got.Status.Workloads) != 1 || got.Status.Workloads[0].Name != "ds" {
+				t.Errorf("%s: Exp the workload recorded by the controller to be kept, got %+v", backup, got.Status)
+			}
+		}
+	})
+
+	t.Run("backups of digest references are referenced by their digest", func(t *testing.T) {
+		c := fake.NewClientBuilder().WithScheme(policyScheme(t)).Build()
+		ctx := context.Background()
+		dep := depFromImages(nil, nil, "dep", "test")
+		b := &BackUPer{Reg: &mockImgNotExistsReg{}, Inventory: c, Obj: dep}
+		bu, err := b.ensureBackup(ctx, "nginx@"+digest('9'), "backup.example.com/b/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		dep.Spec.Template.Spec.Containers = []corev1.Container{{Name: "container-0", Image: bu.ref}}
+		if err := c.Create(ctx, dep); err != nil {
+			t.Fatal(err)
+		}
+		ibs := &v1alpha1.ImageBackupList{}
+		if err := c.List(ctx, ibs); err != nil || len(ibs.Items) != 1 {
+			t.Fatalf("Exp one ImageBackup, got %d, '%v'", len(ibs.Items), err)
+		}
+		// the backup was taken long ago and considered unreferenced before the workload was rewritten
+		ib := &ibs.Items[0]
+		ib.Status.FirstVerified, ib.Status.LastVerified = *ago(30 * 24 * time.Hour), *ago(30 * 24 * time.Hour)
+		ib.Status.UnreferencedSince = ago(10 * 24 * time.Hour)
+		if err := c.Update(ctx, ib); err != nil {
+			t.Fatal(err)
+		}
+
+		reg := &mockDeleteReg{}
+		res, err := CollectGarbage(ctx, c, c, reg, nil, GCOptions{GracePeriod: opts.GracePeriod})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res) != 1 || res[0].Delete || res[0].Reason != "referenced" {
+			t.Errorf("Exp pinned backup to be referenced, got %+v", res)
+		}
+		if len(reg.deleted) != 0 {
+			t.Errorf("Exp no deletes, got '%v'", reg.deleted)
+		}
+		got := &v1alpha1.ImageBackup{}
+		if err := c.Get(ctx, client.ObjectKeyFromObject(ib), got); err != nil {
+			t.Fatal(err)
+		}
+		if len(got.Status.Workloads) != 1 || got.Status.Workloads[0].Name != "dep" {
+			t.Errorf("Exp pinned backup to list its workload, got '%v'", got.Status.Workloads)
+		}
+	})
+
+	t.Run("backups whose inventory update fails keep their digest", func(t *testing.T) {
+		gone := []v1alpha1.WorkloadReference{{Kind: "Deployment", Namespace: "test", Name: "gone"}}
+		failing := ib("backup.example.com/b/dup:1", digest('7'), 30*24*time.Hour, ago(10*24*time.Hour))
+		failing.Status.Workloads = gone
+		shared := ib("backup.example.com/b/dup:2", digest('7'), 20*24*time.Hour, ago(10*24*time.Hour))
+		shared.Status.Workloads = gone
+		c := &failingUpdateClient{
+			Client: fake.NewClientBuilder().WithScheme(policyScheme(t)).WithRuntimeObjects(failing, shared).Build(),
+			fail:   failing.Name,
+		}
+		reg := &mockDeleteReg{}
+
+		res, err := CollectGarbage(context.Background(), c, c, reg, nil, GCOptions{GracePeriod: opts.GracePeriod})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, r := range res {
+			if r.Delete {
+				t.Errorf("Exp backup to be kept, got %+v", r)
+			}
+		}
+		if len(reg.deleted) != 0 {
+			t.Errorf("Exp no deletes, got '%v'", reg.deleted)
+		}
+	})
+}
@@ -0,0 +1,61 @@
+package controller
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// WorkloadImage is an image used by a workload the controller watches
+type WorkloadImage struct {
+	// Image is the original image, before the container was rewritten
+	Image string
+	// Current is the image the container currently uses. It is the backup of Image, if the container was rewritten
+	Current string
+}
+
+// WorkloadImages returns the images of all containers of Deployments and DaemonSets in namespace, which the
+// controller would back up. Namespaces which are not watched, opted out workloads and containers and policies are
+// honored. An empty namespace means all namespaces. Every original image is only returned once
+func WorkloadImages(ctx context.Context, cl client.Client, r *GenericReconciler, namespace string) ([]WorkloadImage, error) {
+	wls, err := listWorkloads(ctx, cl, namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	imgs := []WorkloadImage{}
+	seen := map[string]bool{}
+	for _, wl := range wls {
+		obj := wl.obj
+		watched, err := r.watchesNamespace(ctx, cl, obj.GetNamespace())
+		if err != nil {
+			return nil, err
+		}
+		if !watched || skipWorkload(obj) {
+			continue
+		}
+		g, err := r.policyFor(ctx, cl, obj.GetNamespace())
+		if err != nil {
+			return nil, err
+		}
+
+		pts := podTemplate(obj)
+		origs := originalImages(ctx, pts)
+		optOut := skippedContainers(obj)
+		for _, conts := range [][]corev1.Container{pts.Spec.InitContainers, pts.Spec.Containers} {
+			for _, cont := range conts {
+				img := WorkloadImage{Image: cont.Image, Current: cont.Image}
+				if orig, ok := origs[cont.Name]; ok && g.isBackupOf(cont.Image, orig.Image) {
+					img.Image = orig.Image
+				}
+				if optOut[cont.Name] || !g.selectsImage(img.Image) || seen[img.Image] {
+					continue
+				}
+				seen[img.Image] = true
+				imgs = append(imgs, img)
+			}
+		}
+	}
+	return imgs, nil
+}
@@ -0,0 +1,48 @@
+package controller
+
+import (
+	"context"
+	"testing"
+
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestWorkloadImages(t *testing.T) {
+	rewritten := depFromImages([]string{"index.docker.io/test/library_nginx:1.21"}, nil, "rewritten", "test")
+	rewritten.Spec.Template.Annotations = map[string]string{originalImagesAnnotation: `{"container-0":{"image":"nginx:1.21","backupTime":null}}`}
+	optedOut := depFromImages([]string{"busybox:1.34"}, nil, "opted-out", "test")
+	optedOut.Annotations = map[string]string{skipAnnotation: "true"}
+
+	c := fake.NewClientBuilder().WithRuntimeObjects(
+		rewritten,
+		optedOut,
+		depFromImages([]string{"redis:6", "envoy:v1"}, nil, "dep", "test"),
+		depFromImages([]string{"coredns:1.8"}, nil, "ignored", "kube-system"),
+		dsFromImages([]string{"agent:1"}, []string{"init:1"}, "ds", "test"),
+	).Build()
+	r := &GenericReconciler{
+		Igns:          []string{"kube-system"},
+		BuRegRemote:   "test",
+		ExcludeImages: []string{"envoy:*"},
+	}
+
+	imgs, err := WorkloadImages(context.Background(), c, r, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := map[string]string{
+		"nginx:1.21": "index.docker.io/test/library_nginx:1.21",
+		"redis:6":    "redis:6",
+		"agent:1":    "agent:1",
+		"init:1":     "init:1",
+	}
+	if len(imgs) != len(exp) {
+		t.Fatalf("Exp %d images, got %+v", len(exp), imgs)
+	}
+	for _, img := range imgs {
+		if cur, ok := exp[img.Image]; !ok || cur != img.Current {
+			t.Errorf("Unexpected image %+v", img)
+		}
+	}
+}
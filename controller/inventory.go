@@ -0,0 +1,125 @@
+package controller
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/simontheleg/image-clone-controller/api/v1alpha1"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+)
+
+// verifiedResolution is how often LastVerified of an ImageBackup is updated, if nothing else changed.
+// It avoids writing the ImageBackup on every reconcile of every workload referencing it
+const verifiedResolution = time.Minute
+
+// ImageBackupName returns the name of the ImageBackup recording the backup reference
+func ImageBackupName(backup string) string {
+	sum := sha256.Sum256([]byte(backup))
+	return hex.EncodeToString(sum[:16])
+}
+
+// recordBackup creates or updates the ImageBackup of buRef. If orgRef already is the backup, only an existing
+// ImageBackup is updated, as the original source is unknown. sourceDigest is the digest of the copied manifest, if copied,
+// and buDigest the digest of the backup
+func (b *BackUPer) recordBackup(ctx context.Context, orgRef, buRef name.Reference, sourceDigest, buDigest string, copied bool) error {
+	if b.Inventory == nil {
+		return nil
+	}
+	if buDigest == "" {
+		return errors.New("digest of the backup is unknown")
+	}
+	isBackup := orgRef.Name() == buRef.Name()
+	key := types.NamespacedName{Name: ImageBackupName(buRef.Name())}
+
+	return retry.OnError(retry.DefaultRetry, func(err error) bool {
+		return apierrors.IsConflict(err) || apierrors.IsAlreadyExists(err)
+	}, func() error {
+		now := metav1.Now()
+		ib := &v1alpha1.ImageBackup{}
+		err := b.Inventory.Get(ctx, key, ib)
+		if apierrors.IsNotFound(err) {
+			if isBackup {
+				return nil
+			}
+			ib = &v1alpha1.ImageBackup{
+				ObjectMeta: metav1.ObjectMeta{Name: key.Name},
+				Spec:       v1alpha1.ImageBackupSpec{Source: orgRef.Name(), Backup: buRef.Name()},
+				Status:     v1alpha1.ImageBackupStatus{FirstVerified: now},
+			}
+			if err := b.updateRecord(ctx, ib, buRef, sourceDigest, buDigest, true); err != nil {
+				return err
+			}
+			ib.Status.LastVerified = now
+			return b.Inventory.Create(ctx, ib)
+		}
+		if err != nil {
+			return err
+		}
+
+		old := ib.DeepCopy()
+		if err := b.updateRecord(ctx, ib, buRef, sourceDigest, buDigest, copied && !isBackup); err != nil {
+			return err
+		}
+		if equality.Semantic.DeepEqual(old, ib) && now.Sub(ib.Status.LastVerified.Time) < verifiedResolution {
+			return nil
+		}
+		ib.Status.LastVerified = now
+		return b.Inventory.Update(ctx, ib)
+	})
+}
+
+// updateRecord updates the digests, size and workloads of ib and marks it as referenced. The source digest is only
+// updated if the image has just been copied, as the tag may have moved on since the backup was taken
+func (b *BackUPer) updateRecord(ctx context.Context, ib *v1alpha1.ImageBackup, buRef name.Reference, sourceDigest, buDigest string, copied bool) error {
+	opts := []remote.Option{remote.WithAuth(b.DAuth)}
+
+	if copied {
+		ib.Status.SourceDigest = sourceDigest
+	}
+	if ib.Status.BackupDigest != buDigest || ib.Status.Size == 0 {
+		size, err := b.Reg.Size(ctx, buRef, opts...)
+		if err != nil {
+			return err
+		}
+		ib.Status.BackupDigest = buDigest
+		ib.Status.Size = size
+	}
+
+	// the backup is referenced again, which restarts the grace period of the garbage collection
+	ib.Status.UnreferencedSince = nil
+	if ref, ok := workloadReference(b.Obj); ok {
+		found := false
+		for _, w := range ib.Status.Workloads {
+			if w == ref {
+				found = true
+				break
+			}
+		}
+		if !found {
+			ib.Status.Workloads = append(ib.Status.Workloads, ref)
+		}
+	}
+	return nil
+}
+
+// workloadReference returns the reference of a workload supported by the controller
+func workloadReference(obj runtime.Object) (v1alpha1.WorkloadReference, bool) {
+	switch o := obj.(type) {
+	case *appsv1.Deployment:
+		return v1alpha1.WorkloadReference{Kind: "Deployment", Namespace: o.Namespace, Name: o.Name}, true
+	case *appsv1.DaemonSet:
+		return v1alpha1.WorkloadReference{Kind: "DaemonSet", Namespace: o.Namespace, Name: o.Name}, true
+	}
+	return v1alpha1.WorkloadReference{}, false
+}
@@ -0,0 +1,101 @@
+package controller
+
+import (
+	"context"
+	"testing"
+
+	"github.com/simontheleg/image-clone-controller/api/v1alpha1"
+	"github.com/simontheleg/image-clone-controller/registry"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestRecordBackup(t *testing.T) {
+	ctx := context.Background()
+	c := fake.NewClientBuilder().WithScheme(policyScheme(t)).Build()
+	buRef := "index.docker.io/test/simontheleg_debug-pod:latest"
+	key := types.NamespacedName{Name: ImageBackupName(buRef)}
+
+	// an image which is already the backup does not create a record, as its source is unknown
+	bu := &BackUPer{Reg: &mockImgExistsReg{}, Inventory: c, Obj: depFromImages(nil, nil, "dep", "test")}
+	if _, err := bu.ensureBackup(ctx, buRef, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Get(ctx, key, &v1alpha1.ImageBackup{}); !apierrors.IsNotFound(err) {
+		t.Errorf("Exp no ImageBackup for an unknown source, got '%v'", err)
+	}
+
+	// copying the image creates the record
+	bu = &BackUPer{Reg: &mockImgNotExistsReg{}, Inventory: c, Obj: depFromImages(nil, nil, "dep", "test")}
+	if _, err := bu.ensureBackup(ctx, "simontheleg/debug-pod:latest", "test"); err != nil {
+		t.Fatal(err)
+	}
+	ib := &v1alpha1.ImageBackup{}
+	if err := c.Get(ctx, key, ib); err != nil {
+		t.Fatalf("could not get ImageBackup: '%v'", err)
+	}
+	if ib.Spec.Source != "index.docker.io/simontheleg/debug-pod:latest" || ib.Spec.Backup != buRef {
+		t.Errorf("Unexpected spec: %+v", ib.Spec)
+	}
+	if ib.Status.SourceDigest != mockDigest || ib.Status.BackupDigest != mockDigest || ib.Status.Size != mockSize {
+		t.Errorf("Unexpected status: %+v", ib.Status)
+	}
+	if ib.Status.FirstVerified.IsZero() || ib.Status.LastVerified.IsZero() {
+		t.Error("Exp verification times to be set")
+	}
+	exp := v1alpha1.WorkloadReference{Kind: "Deployment", Namespace: "test", Name: "dep"}
+	if len(ib.Status.Workloads) != 1 || ib.Status.Workloads[0] != exp {
+		t.Errorf("Exp workloads '%v', got '%v'", []v1alpha1.WorkloadReference{exp}, ib.Status.Workloads)
+	}
+
+	// other workloads using the backup are added, including ones already rewritten to it
+	bu = &BackUPer{Reg: &mockImgExistsReg{}, Inventory: c, Obj: dsFromImages(nil, nil, "ds", "test")}
+	if _, err := bu.ensureBackup(ctx, buRef, "test"); err != nil {
+		t.Fatal(err)
+	}
+	ib = &v1alpha1.ImageBackup{}
+	if err := c.Get(ctx, key, ib); err != nil {
+		t.Fatalf("could not get ImageBackup: '%v'", err)
+	}
+	if len(ib.Status.Workloads) != 2 || ib.Status.Workloads[1].Kind != "DaemonSet" {
+		t.Errorf("Exp DaemonSet to be added to workloads, got '%v'", ib.Status.Workloads)
+	}
+	if ib.Spec.Source != "index.docker.io/simontheleg/debug-pod:latest" {
+		t.Errorf("Exp source to be kept, got '%s'", ib.Spec.Source)
+	}
+}
+
+func TestEnsureBackUpBackupDigest(t *testing.T) {
+	tt := map[string]struct {
+		exists bool
+	}{
+		"copied backups take the digest from the copy": {
+			exists: false,
+		},
+		"existing backups take the digest from the existence check": {
+			exists: true,
+		},
+	}
+
+	for name, tc := range tt {
+		t.Run(name, func(t *testing.T) {
+			var reg registry.BackUp
+			if tc.exists {
+				reg = &mockImgExistsReg{}
+			} else {
+				reg = &mockImgNotExistsReg{}
+			}
+			c := fake.NewClientBuilder().WithScheme(policyScheme(t)).Build()
+			bu := &BackUPer{Reg: reg, Inventory: c, AuditLog: &mockSink{}, Obj: depFromImages(nil, nil, "dep", "test")}
+
+			gBu, err := bu.ensureBackup(context.Background(), "simontheleg/debug-pod:latest", "test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if gBu.backupDigest != mockDigest {
+				t.Errorf("Exp backup digest '%s', got '%s'", mockDigest, gBu.backupDigest)
+			}
+		})
+	}
+}
@@ -0,0 +1,43 @@
+package controller
+
+import "sync"
+
+// LiveReconciler holds a GenericReconciler configuration which can be swapped at runtime,
+// e.g. after the configuration file changed. Reconcilers pick up the new configuration on their next reconcile
+type LiveReconciler struct {
+	mu sync.RWMutex
+	r  *GenericReconciler
+}
+
+// NewLiveReconciler returns a LiveReconciler initialised with r
+func NewLiveReconciler(r GenericReconciler) *LiveReconciler {
+	l := &LiveReconciler{}
+	l.Set(r)
+	return l
+}
+
+// Set replaces the current configuration
+func (l *LiveReconciler) Set(r GenericReconciler) {
+	r.Live = nil
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.r = &r
+}
+
+// Get returns the current configuration. The returned value must not be modified
+func (l *LiveReconciler) Get() *GenericReconciler {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.r
+}
+
+// current returns the live configuration if one is set and r otherwise
+func (r *GenericReconciler) current() *GenericReconciler {
+	if r.Live == nil {
+		return r
+	}
+	if l := r.Live.Get(); l != nil {
+		return l
+	}
+	return r
+}
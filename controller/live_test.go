@@ -0,0 +1,56 @@
+package controller
+
+import (
+	"context"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+func TestLiveReconciler(t *testing.T) {
+	dep := depFromImages([]string{"simontheleg/debug-pod:latest"}, []string{}, "test", "test")
+	c := fake.NewClientBuilder().WithRuntimeObjects(dep).Build()
+
+	live := NewLiveReconciler(GenericReconciler{
+		Igns:        []string{"test"},
+		RegClient:   &mockImgExistsReg{},
+		BuRegRemote: "test",
+	})
+	rec := &DeploymentReconciler{
+		cl:                c,
+		GenericReconciler: GenericReconciler{Live: live},
+	}
+	req := reconcile.Request{NamespacedName: types.NamespacedName{Name: "test", Namespace: "test"}}
+
+	getImage := func() string {
+		gotDep := &appsv1.Deployment{}
+		if err := c.Get(context.Background(), req.NamespacedName, gotDep); err != nil {
+			t.Fatalf("could not get deployment: '%v'", err)
+		}
+		return gotDep.Spec.Template.Spec.Containers[0].Image
+	}
+
+	// the namespace is ignored by the initial configuration
+	if _, err := rec.Reconcile(context.Background(), req); err != nil {
+		t.Errorf("Error: exp nil, got '%s'", err)
+	}
+	if got := getImage(); got != "simontheleg/debug-pod:latest" {
+		t.Errorf("Exp image to be untouched, got '%s'", got)
+	}
+
+	// the new configuration is picked up without recreating the reconciler
+	live.Set(GenericReconciler{
+		RegClient:   &mockImgExistsReg{},
+		BuRegRemote: "test",
+		Separator:   "--",
+	})
+	if _, err := rec.Reconcile(context.Background(), req); err != nil {
+		t.Errorf("Error: exp nil, got '%s'", err)
+	}
+	if got := getImage(); got != "index.docker.io/test/simontheleg--debug-pod:latest" {
+		t.Errorf("Exp image 'index.docker.io/test/simontheleg--debug-pod:latest', got '%s'", got)
+	}
+}
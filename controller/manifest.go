@@ -0,0 +1,80 @@
+package controller
+
+import (
+	"context"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/simontheleg/image-clone-controller/manifest"
+)
+
+// ManifestRewrite is the rewrite of the image of a single container in a manifest
+type ManifestRewrite struct {
+	manifest.Image
+	// Backup is the reference the image is rewritten to
+	Backup string
+}
+
+// RewriteManifest backs up the images of all pod templates in the multi document YAML data and returns data with the
+// images replaced by their backups, together with all rewrites. Opt-out annotations, IncludeImages and ExcludeImages
+// are honored. Unless PartialRewrite is set, nothing is rewritten if any backup failed. Failed backups are returned as
+// BackupErrors
+func (r *GenericReconciler) RewriteManifest(ctx context.Context, data []byte) ([]byte, []ManifestRewrite, error) {
+	imgs, err := manifest.Images(data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	skip := func(img manifest.Image) bool {
+		return img.Annotations[skipAnnotation] == "true" || skippedContainerNames(img.Annotations)[img.Container] || !r.selectsImage(img.Image)
+	}
+	images := []string{}
+	seen := map[string]bool{}
+	for _, img := range imgs {
+		if !skip(img) && !seen[img.Image] {
+			seen[img.Image] = true
+			images = append(images, img.Image)
+		}
+	}
+	bus := r.backUpImages(ctx, nil, images)
+
+	var buErrs BackupErrors
+	for _, img := range imgs {
+		if bu, ok := bus[img.Image]; ok && bu.err != nil && !skip(img) {
+			buErrs = append(buErrs, ContainerError{Container: img.Container, Image: img.Image, Err: bu.err})
+		}
+	}
+	if len(buErrs) > 0 && !r.PartialRewrite {
+		return nil, nil, buErrs
+	}
+
+	rws := []ManifestRewrite{}
+	out, err := manifest.Rewrite(data, func(img manifest.Image) string {
+		bu, ok := bus[img.Image]
+		if skip(img) || !ok || bu.err != nil || sameReference(img.Image, bu.ref) {
+			return img.Image
+		}
+		rws = append(rws, ManifestRewrite{Image: img, Backup: bu.ref})
+		return bu.ref
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(buErrs) > 0 {
+		return out, rws, buErrs
+	}
+	return out, rws, nil
+}
+
+// sameReference reports whether both images refer to the same reference, e.g. "nginx:1.21" and
+// "index.docker.io/library/nginx:1.21"
+func sameReference(a, b string) bool {
+	refA, err := name.ParseReference(a)
+	if err != nil {
+		return false
+	}
+	refB, err := name.ParseReference(b)
+	if err != nil {
+		return false
+	}
+	return refA.Name() == refB.Name()
+}
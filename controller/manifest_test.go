@@ -0,0 +1,97 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+const testManifest = `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+  annotations:
+    image-clone-controller/skip-containers: sidecar
+spec:
+  template:
+    spec:
+      containers:
+      - name: app
+        image: nginx:1.21
+      - name: sidecar
+        image: envoy:v1
+      - name: backup
+        image: test/library_busybox:1.34
+---
+apiVersion: apps/v1
+kind: DaemonSet
+metadata:
+  name: agent
+spec:
+  template:
+    spec:
+      containers:
+      - name: agent
+        image: img-b:1
+`
+
+func TestRewriteManifest(t *testing.T) {
+	tt := map[string]struct {
+		partialRewrite bool
+		expOut         string
+		expRewrites    int
+		expErr         bool
+	}{
+		"failed backup aborts rewrite": {
+			expErr: true,
+		},
+		"partial rewrite": {
+			partialRewrite: true,
+			expOut:         strings.Replace(testManifest, "image: nginx:1.21", "image: index.docker.io/test/library_nginx:1.21", 1),
+			expRewrites:    1,
+			expErr:         true,
+		},
+	}
+
+	for name, tc := range tt {
+		t.Run(name, func(t *testing.T) {
+			r := &GenericReconciler{
+				RegClient:      &mockSlowReg{failImage: "index.docker.io/library/img-b:1"},
+				BuRegRemote:    "test",
+				PartialRewrite: tc.partialRewrite,
+			}
+			out, rws, err := r.RewriteManifest(context.Background(), []byte(testManifest))
+
+			var buErrs BackupErrors
+			if tc.expErr != errors.As(err, &buErrs) {
+				t.Fatalf("Exp BackupErrors '%t', got '%v'", tc.expErr, err)
+			}
+			if string(out) != tc.expOut {
+				t.Errorf("Exp:\n%s\ngot:\n%s", tc.expOut, out)
+			}
+			if len(rws) != tc.expRewrites {
+				t.Fatalf("Exp %d rewrites, got %+v", tc.expRewrites, rws)
+			}
+			if tc.expRewrites > 0 && (rws[0].Container != "app" || rws[0].Backup != "index.docker.io/test/library_nginx:1.21") {
+				t.Errorf("Unexpected rewrite %+v", rws[0])
+			}
+		})
+	}
+}
+
+func TestRewriteManifestSkipCopy(t *testing.T) {
+	reg := &mockImgNotExistsReg{}
+	r := &GenericReconciler{RegClient: reg, BuRegRemote: "test", SkipCopy: true}
+
+	_, rws, err := r.RewriteManifest(context.Background(), []byte(testManifest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rws) != 2 || rws[1].Backup != "index.docker.io/test/library_img-b:1" {
+		t.Errorf("Exp backup references of 2 images, got %+v", rws)
+	}
+	if reg.referenceExistsCalled != 0 || reg.backUpImageCalled != 0 {
+		t.Errorf("Exp no registry requests, got %d existence checks and %d copies", reg.referenceExistsCalled, reg.backUpImageCalled)
+	}
+}
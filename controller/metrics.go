@@ -0,0 +1,29 @@
+package controller
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var (
+	rewritesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "image_clone_controller_rewrites_total",
+		Help: "Number of workloads rewritten to use images from the backup registry, by workload kind",
+	}, []string{"kind"})
+	backupsSkippedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "image_clone_controller_backups_skipped_total",
+		Help: "Number of backups which were not copied, by reason",
+	}, []string{"reason"})
+	gcDeletedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "image_clone_controller_gc_deleted_total",
+		Help: "Number of manifests deleted from the backup registry by the garbage collection",
+	})
+)
+
+func init() {
+	metrics.Registry.MustRegister(
+		rewritesTotal,
+		backupsSkippedTotal,
+		gcDeletedTotal,
+	)
+}
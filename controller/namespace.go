@@ -0,0 +1,86 @@
+package controller
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// watchesNamespace reports whether workloads in the namespace should be reconciled. Namespaces on the ignore list
+// are never watched. If NsSelector or NsExcludeSelector are set, the labels of the namespace are looked up to match them
+func (r *GenericReconciler) watchesNamespace(ctx context.Context, cl client.Reader, namespace string) (bool, error) {
+	for _, ign := range r.Igns {
+		if ign == namespace {
+			return false, nil
+		}
+	}
+	if !r.selectsNamespaces() {
+		return true, nil
+	}
+
+	ns := &corev1.Namespace{}
+	err := cl.Get(ctx, types.NamespacedName{Name: namespace}, ns)
+	if apierrors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return r.matchesNamespace(ns), nil
+}
+
+// selectsNamespaces reports whether any namespace label selectors are configured
+func (r *GenericReconciler) selectsNamespaces() bool {
+	return r.NsSelector != nil || r.NsExcludeSelector != nil
+}
+
+// matchesNamespace reports whether the labels of ns match NsSelector and do not match NsExcludeSelector
+func (r *GenericReconciler) matchesNamespace(ns *corev1.Namespace) bool {
+	set := labels.Set(ns.Labels)
+	if r.NsSelector != nil && !r.NsSelector.Matches(set) {
+		return false
+	}
+	if r.NsExcludeSelector != nil && r.NsExcludeSelector.Matches(set) {
+		return false
+	}
+	return true
+}
+
+// namespaceRequests returns a reconcile.Request for each workload in list, which must be filled by listing the namespace.
+// An empty namespace lists workloads of all namespaces
+func namespaceRequests(ctx context.Context, cl client.Reader, namespace string, list client.ObjectList, items func() []client.Object) []reconcile.Request {
+	if err := cl.List(ctx, list, client.InNamespace(namespace)); err != nil {
+		return nil
+	}
+	reqs := []reconcile.Request{}
+	for _, obj := range items() {
+		reqs = append(reqs, reconcile.Request{NamespacedName: types.NamespacedName{Namespace: obj.GetNamespace(), Name: obj.GetName()}})
+	}
+	return reqs
+}
+
+// namespaceLabelsPredicate only passes events of namespaces whose labels have changed, so their workloads are
+// reconciled once a namespace gets included by the label selectors
+func namespaceLabelsPredicate() predicate.Predicate {
+	return predicate.Funcs{
+		CreateFunc: func(ce event.CreateEvent) bool {
+			return true
+		},
+		UpdateFunc: func(ue event.UpdateEvent) bool {
+			return !labels.Equals(ue.ObjectOld.GetLabels(), ue.ObjectNew.GetLabels())
+		},
+		DeleteFunc: func(de event.DeleteEvent) bool {
+			return false
+		},
+		GenericFunc: func(ge event.GenericEvent) bool {
+			return false
+		},
+	}
+}
@@ -0,0 +1,122 @@
+package controller
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+)
+
+func TestWatchesNamespace(t *testing.T) {
+	nsFromLabels := func(name string, l map[string]string) *corev1.Namespace {
+		return &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: l}}
+	}
+	c := fake.NewClientBuilder().WithRuntimeObjects(
+		nsFromLabels("kube-system", map[string]string{"backup": "true"}),
+		nsFromLabels("included", map[string]string{"backup": "true"}),
+		nsFromLabels("excluded", map[string]string{"backup": "true", "vendor": "true"}),
+		nsFromLabels("unlabeled", nil),
+	).Build()
+
+	tt := map[string]struct {
+		include string
+		exclude string
+		ns      string
+		exp     bool
+	}{
+		"no selectors": {
+			ns:  "unlabeled",
+			exp: true,
+		},
+		"ignore list takes precedence": {
+			include: "backup=true",
+			ns:      "kube-system",
+			exp:     false,
+		},
+		"included": {
+			include: "backup=true",
+			exclude: "vendor=true",
+			ns:      "included",
+			exp:     true,
+		},
+		"excluded": {
+			include: "backup=true",
+			exclude: "vendor=true",
+			ns:      "excluded",
+			exp:     false,
+		},
+		"not included": {
+			include: "backup=true",
+			ns:      "unlabeled",
+			exp:     false,
+		},
+		"missing namespace": {
+			include: "backup=true",
+			ns:      "missing",
+			exp:     false,
+		},
+	}
+
+	for name, tc := range tt {
+		t.Run(name, func(t *testing.T) {
+			rec := &GenericReconciler{Igns: []string{"kube-system"}}
+			if tc.include != "" {
+				rec.NsSelector, _ = labels.Parse(tc.include)
+			}
+			if tc.exclude != "" {
+				rec.NsExcludeSelector, _ = labels.Parse(tc.exclude)
+			}
+
+			got, err := rec.watchesNamespace(context.Background(), c, tc.ns)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.exp {
+				t.Errorf("Exp watched '%t', got '%t'", tc.exp, got)
+			}
+		})
+	}
+}
+
+func TestNamespaceLabelsPredicate(t *testing.T) {
+	pred := namespaceLabelsPredicate()
+
+	old := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "test", Labels: map[string]string{"a": "b"}}}
+	same := old.DeepCopy()
+	same.Annotations = map[string]string{"unrelated": "change"}
+	relabeled := old.DeepCopy()
+	relabeled.Labels["backup"] = "true"
+
+	if pred.Update(event.UpdateEvent{ObjectOld: old, ObjectNew: same}) {
+		t.Error("Exp update without label changes to be filtered")
+	}
+	if !pred.Update(event.UpdateEvent{ObjectOld: old, ObjectNew: relabeled}) {
+		t.Error("Exp update with label changes to pass")
+	}
+	if pred.Delete(event.DeleteEvent{Object: old}) {
+		t.Error("Exp delete to be filtered")
+	}
+}
+
+func TestDeploymentMapNamespace(t *testing.T) {
+	c := fake.NewClientBuilder().WithRuntimeObjects(
+		depFromImages([]string{"nginx:latest"}, []string{}, "a", "included"),
+		depFromImages([]string{"nginx:latest"}, []string{}, "b", "included"),
+		depFromImages([]string{"nginx:latest"}, []string{}, "c", "other"),
+	).Build()
+	rec := &DeploymentReconciler{cl: c}
+
+	reqs := rec.mapNamespace(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "included"}})
+	if len(reqs) != 2 {
+		t.Fatalf("Exp 2 requests, got %v", reqs)
+	}
+	for _, req := range reqs {
+		if req.Namespace != "included" {
+			t.Errorf("Exp request in namespace 'included', got '%s'", req.NamespacedName)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package controller
+
+import (
+	"time"
+
+	"golang.org/x/time/rate"
+	"k8s.io/client-go/util/workqueue"
+	ctrlcontroller "sigs.k8s.io/controller-runtime/pkg/controller"
+)
+
+// Defaults of the controller-runtime rate limiter, used if only one of the delays is configured
+const (
+	defaultRateLimiterBaseDelay = 5 * time.Millisecond
+	defaultRateLimiterMaxDelay  = 1000 * time.Second
+)
+
+// ControllerOptions tune the workqueue of a reconciler. Zero values keep the controller-runtime defaults
+type ControllerOptions struct {
+	// Maximum number of workloads reconciled in parallel. Defaults to 1
+	MaxConcurrentReconciles int
+	// Initial delay of the exponential backoff of failed reconciles. Defaults to 5ms
+	RateLimiterBaseDelay time.Duration
+	// Maximum delay of the exponential backoff of failed reconciles. Defaults to 1000s
+	RateLimiterMaxDelay time.Duration
+}
+
+// options returns the controller-runtime options of the reconciler
+func (o ControllerOptions) options() ctrlcontroller.Options {
+	opts := ctrlcontroller.Options{MaxConcurrentReconciles: o.MaxConcurrentReconciles}
+	if o.RateLimiterBaseDelay > 0 || o.RateLimiterMaxDelay > 0 {
+		base, max := o.RateLimiterBaseDelay, o.RateLimiterMaxDelay
+		if base <= 0 {
+			base = defaultRateLimiterBaseDelay
+		}
+		if max <= 0 {
+			max = defaultRateLimiterMaxDelay
+		}
+		// same as workqueue.DefaultControllerRateLimiter, but with our delays
+		opts.RateLimiter = workqueue.NewMaxOfRateLimiter(
+			workqueue.NewItemExponentialFailureRateLimiter(base, max),
+			&workqueue.BucketRateLimiter{Limiter: rate.NewLimiter(rate.Limit(10), 100)},
+		)
+	}
+	return opts
+}
@@ -0,0 +1,46 @@
+package controller
+
+import (
+	"testing"
+	"time"
+)
+
+func TestControllerOptions(t *testing.T) {
+	tt := map[string]struct {
+		opts       ControllerOptions
+		expLimiter bool
+		expDelays  []time.Duration
+	}{
+		"defaults": {
+			opts: ControllerOptions{},
+		},
+		"base delay": {
+			opts:       ControllerOptions{RateLimiterBaseDelay: time.Second},
+			expLimiter: true,
+			expDelays:  []time.Duration{time.Second, 2 * time.Second, 4 * time.Second},
+		},
+		"base and max delay": {
+			opts:       ControllerOptions{RateLimiterBaseDelay: time.Second, RateLimiterMaxDelay: 3 * time.Second},
+			expLimiter: true,
+			expDelays:  []time.Duration{time.Second, 2 * time.Second, 3 * time.Second},
+		},
+	}
+
+	for name, tc := range tt {
+		t.Run(name, func(t *testing.T) {
+			tc.opts.MaxConcurrentReconciles = 4
+			got := tc.opts.options()
+			if got.MaxConcurrentReconciles != 4 {
+				t.Errorf("Exp 4 concurrent reconciles, got %d", got.MaxConcurrentReconciles)
+			}
+			if (got.RateLimiter != nil) != tc.expLimiter {
+				t.Fatalf("Exp rate limiter '%t', got '%v'", tc.expLimiter, got.RateLimiter)
+			}
+			for i, exp := range tc.expDelays {
+				if d := got.RateLimiter.When("item"); d != exp {
+					t.Errorf("Retry %d: exp delay '%s', got '%s'", i, exp, d)
+				}
+			}
+		})
+	}
+}
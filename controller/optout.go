@@ -0,0 +1,38 @@
+package controller
+
+import (
+	"strings"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// skipAnnotation set to "true" on a workload excludes it from backups and rewrites entirely
+	skipAnnotation = "image-clone-controller/skip"
+	// skipContainersAnnotation holds a comma separated list of container names, which are neither backed up nor rewritten
+	skipContainersAnnotation = "image-clone-controller/skip-containers"
+)
+
+// skipWorkload reports whether the workload opted out of backups
+func skipWorkload(obj client.Object) bool {
+	return obj.GetAnnotations()[skipAnnotation] == "true"
+}
+
+// skippedContainers returns the names of all containers of the workload, which opted out of backups
+func skippedContainers(obj client.Object) map[string]bool {
+	if obj == nil {
+		return map[string]bool{}
+	}
+	return skippedContainerNames(obj.GetAnnotations())
+}
+
+// skippedContainerNames returns the names of all containers listed in the skipContainersAnnotation of annos
+func skippedContainerNames(annos map[string]string) map[string]bool {
+	skip := map[string]bool{}
+	for _, n := range strings.Split(annos[skipContainersAnnotation], ",") {
+		if n = strings.TrimSpace(n); n != "" {
+			skip[n] = true
+		}
+	}
+	return skip
+}
@@ -0,0 +1,79 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// originalImagesAnnotation holds a JSON map of container name to OriginalImage.
+// It is set on rewritten workloads as well as on their PodTemplateSpec
+const originalImagesAnnotation = "image-clone-controller/original-images"
+
+// OriginalImage records which image a container used, before it was rewritten to the backup
+type OriginalImage struct {
+	Image string `json:"image"`
+	// Digest of the manifest copied from Image. If the backup already existed, it is the digest of the backup, which only
+	// differs if platforms of an index were filtered
+	Digest     string      `json:"digest,omitempty"`
+	BackupTime metav1.Time `json:"backupTime"`
+}
+
+// originalImages parses the originalImagesAnnotation of obj. Invalid annotations are logged and ignored
+func originalImages(ctx context.Context, obj metav1.Object) map[string]OriginalImage {
+	origs := map[string]OriginalImage{}
+	val, ok := obj.GetAnnotations()[originalImagesAnnotation]
+	if !ok {
+		return origs
+	}
+	if err := json.Unmarshal([]byte(val), &origs); err != nil {
+		log.FromContext(ctx).Error(err, "Ignoring invalid annotation", "annotation", originalImagesAnnotation)
+		return map[string]OriginalImage{}
+	}
+	return origs
+}
+
+// setOriginalImages stores origs in the originalImagesAnnotation of the PodTemplateSpec or removes the annotation
+// if origs is empty. It returns whether the annotation has changed
+func setOriginalImages(pts *corev1.PodTemplateSpec, origs map[string]OriginalImage) bool {
+	val := ""
+	if len(origs) > 0 {
+		// marshalling a map with basic fields can not fail
+		b, _ := json.Marshal(origs)
+		val = string(b)
+	}
+	return setAnnotation(pts, originalImagesAnnotation, val)
+}
+
+// copyOriginalImages copies the originalImagesAnnotation from a PodTemplateSpec to its workload.
+// It returns whether the annotations of the workload have changed
+func copyOriginalImages(pts *corev1.PodTemplateSpec, obj metav1.Object) bool {
+	return setAnnotation(obj, originalImagesAnnotation, pts.GetAnnotations()[originalImagesAnnotation])
+}
+
+// setAnnotation sets the annotation key to val, or removes it if val is empty.
+// It returns whether the annotations have changed
+func setAnnotation(obj metav1.Object, key, val string) bool {
+	annos := obj.GetAnnotations()
+	cur, ok := annos[key]
+	if val == "" {
+		if !ok {
+			return false
+		}
+		delete(annos, key)
+		obj.SetAnnotations(annos)
+		return true
+	}
+	if ok && cur == val {
+		return false
+	}
+	if annos == nil {
+		annos = map[string]string{}
+	}
+	annos[key] = val
+	obj.SetAnnotations(annos)
+	return true
+}
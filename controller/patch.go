@@ -0,0 +1,81 @@
+package controller
+
+import (
+	"encoding/json"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// fieldManager is the name the controller uses when patching workloads
+const fieldManager = "image-clone-controller"
+
+// workloadPatch builds a strategic merge patch for a workload containing a PodTemplateSpec (e.g. Deployments or DaemonSets).
+// It only touches the images of containers which differ between oldTmpl and newTmpl and the annotations which differ
+// between oldMeta and newMeta or the templates, so concurrent changes of other fields by different managers are left intact.
+// Containers are matched by name, which is the merge key of the Kubernetes API.
+// The resourceVersion of oldMeta is a precondition of the patch, so it fails with a conflict if the workload changed since
+// it was read, instead of overwriting images changed in the meantime
+func workloadPatch(oldMeta, newMeta metav1.Object, oldTmpl, newTmpl *corev1.PodTemplateSpec) ([]byte, error) {
+	patch := map[string]interface{}{}
+
+	if annos := annotationsPatch(oldMeta.GetAnnotations(), newMeta.GetAnnotations()); len(annos) > 0 {
+		patch["metadata"] = map[string]interface{}{"annotations": annos}
+	}
+
+	podSpec := map[string]interface{}{}
+	if conts := containersPatch(oldTmpl.Spec.InitContainers, newTmpl.Spec.InitContainers); len(conts) > 0 {
+		podSpec["initContainers"] = conts
+	}
+	if conts := containersPatch(oldTmpl.Spec.Containers, newTmpl.Spec.Containers); len(conts) > 0 {
+		podSpec["containers"] = conts
+	}
+	tmpl := map[string]interface{}{}
+	if len(podSpec) > 0 {
+		tmpl["spec"] = podSpec
+	}
+	if annos := annotationsPatch(oldTmpl.GetAnnotations(), newTmpl.GetAnnotations()); len(annos) > 0 {
+		tmpl["metadata"] = map[string]interface{}{"annotations": annos}
+	}
+	if len(tmpl) > 0 {
+		patch["spec"] = map[string]interface{}{"template": tmpl}
+	}
+
+	if rv := oldMeta.GetResourceVersion(); rv != "" && len(patch) > 0 {
+		meta, ok := patch["metadata"].(map[string]interface{})
+		if !ok {
+			meta = map[string]interface{}{}
+			patch["metadata"] = meta
+		}
+		meta["resourceVersion"] = rv
+	}
+
+	return json.Marshal(patch)
+}
+
+// annotationsPatch returns all changed annotations. Removed annotations are set to nil
+func annotationsPatch(old, upd map[string]string) map[string]interface{} {
+	annos := map[string]interface{}{}
+	for k, v := range upd {
+		if ov, ok := old[k]; !ok || ov != v {
+			annos[k] = v
+		}
+	}
+	for k := range old {
+		if _, ok := upd[k]; !ok {
+			annos[k] = nil
+		}
+	}
+	return annos
+}
+
+// containersPatch returns name and image of every container whose image changed
+func containersPatch(old, upd []corev1.Container) []map[string]string {
+	conts := []map[string]string{}
+	for p := range old {
+		if p < len(upd) && old[p].Image != upd[p].Image {
+			conts = append(conts, map[string]string{"name": upd[p].Name, "image": upd[p].Image})
+		}
+	}
+	return conts
+}
@@ -0,0 +1,71 @@
+package controller
+
+import (
+	"fmt"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestWorkloadPatch(t *testing.T) {
+	tt := map[string]struct {
+		oldRV    string
+		oldAnnos map[string]string
+		newAnnos map[string]string
+		oldImgs  []string
+		newImgs  []string
+		exp      string
+	}{
+		"nothing changed": {
+			oldImgs: []string{"nginx:latest"},
+			newImgs: []string{"nginx:latest"},
+			exp:     `{}`,
+		},
+		"only changed images are patched": {
+			oldImgs: []string{"nginx:latest", "test/library_redis:6"},
+			newImgs: []string{"test/library_nginx:latest", "test/library_redis:6"},
+			exp:     `{"spec":{"template":{"spec":{"containers":[{"image":"test/library_nginx:latest","name":"container-0"}]}}}}`,
+		},
+		"annotations are added and removed": {
+			oldAnnos: map[string]string{"keep": "me", "remove": "me"},
+			newAnnos: map[string]string{"keep": "me", "add": "me"},
+			oldImgs:  []string{"nginx:latest"},
+			newImgs:  []string{"nginx:latest"},
+			exp:      `{"metadata":{"annotations":{"add":"me","remove":null}}}`,
+		},
+		"resourceVersion is a precondition": {
+			oldRV:   "42",
+			oldImgs: []string{"nginx:latest"},
+			newImgs: []string{"test/library_nginx:latest"},
+			exp:     `{"metadata":{"resourceVersion":"42"},"spec":{"template":{"spec":{"containers":[{"image":"test/library_nginx:latest","name":"container-0"}]}}}}`,
+		},
+		"no precondition without changes": {
+			oldRV:   "42",
+			oldImgs: []string{"nginx:latest"},
+			newImgs: []string{"nginx:latest"},
+			exp:     `{}`,
+		},
+	}
+
+	for name, tc := range tt {
+		t.Run(name, func(t *testing.T) {
+			oldMeta := &metav1.ObjectMeta{ResourceVersion: tc.oldRV, Annotations: tc.oldAnnos}
+			newMeta := &metav1.ObjectMeta{Annotations: tc.newAnnos}
+			oldTmpl := &corev1.PodTemplateSpec{}
+			newTmpl := &corev1.PodTemplateSpec{}
+			for p := range tc.oldImgs {
+				oldTmpl.Spec.Containers = append(oldTmpl.Spec.Containers, corev1.Container{Name: fmt.Sprintf("container-%d", p), Image: tc.oldImgs[p]})
+				newTmpl.Spec.Containers = append(newTmpl.Spec.Containers, corev1.Container{Name: fmt.Sprintf("container-%d", p), Image: tc.newImgs[p]})
+			}
+
+			got, err := workloadPatch(oldMeta, newMeta, oldTmpl, newTmpl)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tc.exp {
+				t.Errorf("Exp patch '%s', got '%s'", tc.exp, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,126 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/simontheleg/image-clone-controller/api/v1alpha1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// policyFor returns the configuration for workloads in namespace. If Policies is set, the spec of the namespace's
+// ImageClonePolicy, or otherwise of the ClusterImageClonePolicy, is applied on top of a copy of r. Invalid policies are ignored
+func (r *GenericReconciler) policyFor(ctx context.Context, cl client.Reader, namespace string) (*GenericReconciler, error) {
+	if !r.Policies {
+		return r, nil
+	}
+	log := log.FromContext(ctx)
+
+	nsPols := &v1alpha1.ImageClonePolicyList{}
+	if err := cl.List(ctx, nsPols, client.InNamespace(namespace)); err != nil {
+		return nil, err
+	}
+	sort.Slice(nsPols.Items, func(i, j int) bool { return nsPols.Items[i].Name < nsPols.Items[j].Name })
+	for _, pol := range nsPols.Items {
+		if validatePolicy(&pol.Spec, true) == nil {
+			log.V(1).Info("Applying policy", "imageclonepolicy", client.ObjectKeyFromObject(&pol))
+			return r.withPolicy(&pol.Spec), nil
+		}
+	}
+
+	clPols := &v1alpha1.ClusterImageClonePolicyList{}
+	if err := cl.List(ctx, clPols); err != nil {
+		return nil, err
+	}
+	sort.Slice(clPols.Items, func(i, j int) bool { return clPols.Items[i].Name < clPols.Items[j].Name })
+	for _, pol := range clPols.Items {
+		if validatePolicy(&pol.Spec, false) == nil {
+			log.V(1).Info("Applying policy", "clusterimageclonepolicy", pol.Name)
+			return r.withPolicy(&pol.Spec), nil
+		}
+	}
+
+	return r, nil
+}
+
+// withPolicy returns a copy of r with spec applied
+func (r *GenericReconciler) withPolicy(spec *v1alpha1.ImageClonePolicySpec) *GenericReconciler {
+	g := *r
+	if spec.DestinationRegistry != "" {
+		g.BuRegRemote = spec.DestinationRegistry
+	}
+	g.IncludeImages = spec.IncludeImages
+	g.ExcludeImages = spec.ExcludeImages
+	// without rewrites, images are still backed up, but workloads are only audited
+	if spec.Rewrite != nil && !*spec.Rewrite && g.Mode != ModeAudit {
+		g.Mode = ModeAudit
+		g.AuditCopy = true
+	}
+	if spec.ResyncInterval != nil {
+		g.ResyncInterval = spec.ResyncInterval.Duration
+	}
+	return &g
+}
+
+// validatePolicy checks the spec of an ImageClonePolicy, if namespaced, or ClusterImageClonePolicy for errors.
+// Backups are pushed with the credentials of the controller, so only ClusterImageClonePolicies, which are created by
+// cluster administrators, may change the destination registry
+func validatePolicy(spec *v1alpha1.ImageClonePolicySpec, namespaced bool) error {
+	if spec.DestinationRegistry != "" && namespaced {
+		return errors.New("destinationRegistry: only allowed in ClusterImageClonePolicies")
+	}
+	if spec.DestinationRegistry != "" {
+		if _, err := name.NewRepository(strings.TrimSuffix(spec.DestinationRegistry, "/")); err != nil {
+			return fmt.Errorf("destinationRegistry: %w", err)
+		}
+	}
+	for _, p := range spec.IncludeImages {
+		if p == "" {
+			return errors.New("includeImages: patterns must not be empty")
+		}
+	}
+	for _, p := range spec.ExcludeImages {
+		if p == "" {
+			return errors.New("excludeImages: patterns must not be empty")
+		}
+	}
+	if spec.ResyncInterval != nil && spec.ResyncInterval.Duration <= 0 {
+		return fmt.Errorf("resyncInterval: must be positive, got %s", spec.ResyncInterval.Duration)
+	}
+	return nil
+}
+
+// selectsImage reports whether image matches IncludeImages, if set, and does not match ExcludeImages
+func (r *GenericReconciler) selectsImage(image string) bool {
+	if len(r.IncludeImages) > 0 && !matchesImage(r.IncludeImages, image) {
+		return false
+	}
+	return !matchesImage(r.ExcludeImages, image)
+}
+
+// matchesImage reports whether image matches any of patterns. Patterns are matched against the image as written
+// in the workload and against its fully qualified name, '*' matches any sequence of characters
+func matchesImage(patterns []string, image string) bool {
+	names := []string{image}
+	if ref, err := name.ParseReference(image); err == nil {
+		names = append(names, ref.Name())
+	}
+	for _, p := range patterns {
+		re, err := regexp.Compile("^" + strings.ReplaceAll(regexp.QuoteMeta(p), `\*`, ".*") + "$")
+		if err != nil {
+			continue
+		}
+		for _, n := range names {
+			if re.MatchString(n) {
+				return true
+			}
+		}
+	}
+	return false
+}
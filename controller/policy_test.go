@@ -0,0 +1,269 @@
+package controller
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/simontheleg/image-clone-controller/api/v1alpha1"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// policyScheme returns a scheme containing the builtin types and the policies
+func policyScheme(t *testing.T) *runtime.Scheme {
+	s := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(s); err != nil {
+		t.Fatal(err)
+	}
+	if err := v1alpha1.AddToScheme(s); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestPolicyFor(t *testing.T) {
+	nsPol := func(ns, name, include string) *v1alpha1.ImageClonePolicy {
+		return &v1alpha1.ImageClonePolicy{
+			ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: name},
+			Spec:       v1alpha1.ImageClonePolicySpec{IncludeImages: []string{include}},
+		}
+	}
+	c := fake.NewClientBuilder().WithScheme(policyScheme(t)).WithRuntimeObjects(
+		nsPol("team-a", "b", "team-a-b"),
+		nsPol("team-a", "a", "team-a-a"),
+		nsPol("team-b", "a", ""),
+		nsPol("team-b", "b", "team-b-b"),
+		nsPol("team-c", "a", ""),
+		&v1alpha1.ImageClonePolicy{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "team-e", Name: "a"},
+			Spec:       v1alpha1.ImageClonePolicySpec{DestinationRegistry: "attacker.example.com/"},
+		},
+		&v1alpha1.ClusterImageClonePolicy{
+			ObjectMeta: metav1.ObjectMeta{Name: "default"},
+			Spec:       v1alpha1.ImageClonePolicySpec{DestinationRegistry: "cluster/", IncludeImages: []string{"cluster"}},
+		},
+	).Build()
+
+	tt := map[string]struct {
+		policies   bool
+		ns         string
+		expReg     string
+		expInclude []string
+	}{
+		"policies disabled": {
+			ns:     "team-a",
+			expReg: "controller/",
+		},
+		"first policy by name": {
+			policies:   true,
+			ns:         "team-a",
+			expReg:     "controller/",
+			expInclude: []string{"team-a-a"},
+		},
+		"invalid policies are skipped": {
+			policies:   true,
+			ns:         "team-b",
+			expReg:     "controller/",
+			expInclude: []string{"team-b-b"},
+		},
+		"cluster policy if no valid policy exists": {
+			policies:   true,
+			ns:         "team-c",
+			expReg:     "cluster/",
+			expInclude: []string{"cluster"},
+		},
+		"cluster policy if no policy exists": {
+			policies:   true,
+			ns:         "team-d",
+			expReg:     "cluster/",
+			expInclude: []string{"cluster"},
+		},
+		"namespaced policies must not change the destination registry": {
+			policies:   true,
+			ns:         "team-e",
+			expReg:     "cluster/",
+			expInclude: []string{"cluster"},
+		},
+	}
+
+	for name, tc := range tt {
+		t.Run(name, func(t *testing.T) {
+			r := &GenericReconciler{BuRegRemote: "controller/", Policies: tc.policies}
+			g, err := r.policyFor(context.Background(), c, tc.ns)
+			if err != nil {
+				t.Fatalf("Exp no error, got '%v'", err)
+			}
+			if g.BuRegRemote != tc.expReg {
+				t.Errorf("Exp backup registry '%s', got '%s'", tc.expReg, g.BuRegRemote)
+			}
+			if len(g.IncludeImages) != len(tc.expInclude) || (len(tc.expInclude) > 0 && g.IncludeImages[0] != tc.expInclude[0]) {
+				t.Errorf("Exp included images %v, got %v", tc.expInclude, g.IncludeImages)
+			}
+			if r.BuRegRemote != "controller/" {
+				t.Error("policy must not modify the original configuration")
+			}
+		})
+	}
+}
+
+func TestWithPolicy(t *testing.T) {
+	noRewrite := false
+	r := &GenericReconciler{BuRegRemote: "controller/", Mode: ModeEnforce}
+	g := r.withPolicy(&v1alpha1.ImageClonePolicySpec{
+		Rewrite:        &noRewrite,
+		ResyncInterval: &metav1.Duration{Duration: time.Hour},
+	})
+	if g.Mode != ModeAudit || !g.AuditCopy {
+		t.Errorf("Exp audit mode with copies, got mode '%s' and auditCopy '%t'", g.Mode, g.AuditCopy)
+	}
+	if g.ResyncInterval != time.Hour {
+		t.Errorf("Exp resync interval '1h', got '%s'", g.ResyncInterval)
+	}
+	if g.BuRegRemote != "controller/" {
+		t.Errorf("Exp backup registry of the controller, got '%s'", g.BuRegRemote)
+	}
+}
+
+func TestValidatePolicy(t *testing.T) {
+	tt := map[string]struct {
+		spec       v1alpha1.ImageClonePolicySpec
+		namespaced bool
+		expErr     bool
+	}{
+		"empty": {},
+		"valid": {
+			spec: v1alpha1.ImageClonePolicySpec{
+				DestinationRegistry: "registry.example.com/backup/",
+				IncludeImages:       []string{"quay.io/*"},
+				ResyncInterval:      &metav1.Duration{Duration: time.Hour},
+			},
+		},
+		"valid namespaced": {
+			spec:       v1alpha1.ImageClonePolicySpec{IncludeImages: []string{"quay.io/*"}},
+			namespaced: true,
+		},
+		"namespaced destination registry": {
+			spec:       v1alpha1.ImageClonePolicySpec{DestinationRegistry: "registry.example.com/backup/"},
+			namespaced: true,
+			expErr:     true,
+		},
+		"invalid registry": {
+			spec:   v1alpha1.ImageClonePolicySpec{DestinationRegistry: "Invalid Registry"},
+			expErr: true,
+		},
+		"empty pattern": {
+			spec:   v1alpha1.ImageClonePolicySpec{ExcludeImages: []string{""}},
+			expErr: true,
+		},
+		"negative resync": {
+			spec:   v1alpha1.ImageClonePolicySpec{ResyncInterval: &metav1.Duration{Duration: -time.Hour}},
+			expErr: true,
+		},
+	}
+
+	for name, tc := range tt {
+		t.Run(name, func(t *testing.T) {
+			err := validatePolicy(&tc.spec, tc.namespaced)
+			if (err != nil) != tc.expErr {
+				t.Errorf("Exp error '%t', got '%v'", tc.expErr, err)
+			}
+		})
+	}
+}
+
+func TestSelectsImage(t *testing.T) {
+	tt := map[string]struct {
+		include []string
+		exclude []string
+		image   string
+		exp     bool
+	}{
+		"no patterns": {
+			image: "nginx:1.21",
+			exp:   true,
+		},
+		"included by fully qualified name": {
+			include: []string{"index.docker.io/library/*"},
+			image:   "nginx:1.21",
+			exp:     true,
+		},
+		"not included": {
+			include: []string{"quay.io/*"},
+			image:   "nginx:1.21",
+			exp:     false,
+		},
+		"excluded as written": {
+			exclude: []string{"nginx:*"},
+			image:   "nginx:1.21",
+			exp:     false,
+		},
+		"exclude takes precedence": {
+			include: []string{"quay.io/*"},
+			exclude: []string{"quay.io/prometheus/*"},
+			image:   "quay.io/prometheus/node-exporter:v1.2.2",
+			exp:     false,
+		},
+		"special characters are matched literally": {
+			include: []string{"nginx:1.2?"},
+			image:   "nginx:1.21",
+			exp:     false,
+		},
+	}
+
+	for name, tc := range tt {
+		t.Run(name, func(t *testing.T) {
+			r := &GenericReconciler{IncludeImages: tc.include, ExcludeImages: tc.exclude}
+			if got := r.selectsImage(tc.image); got != tc.exp {
+				t.Errorf("Exp '%t', got '%t'", tc.exp, got)
+			}
+		})
+	}
+}
+
+func TestDeploymentControllerPolicy(t *testing.T) {
+	dep := depFromImages([]string{"simontheleg/debug-pod:latest", "quay.io/prometheus/node-exporter:v1.2.2"}, []string{}, "test", "test")
+	pol := &v1alpha1.ClusterImageClonePolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "policy"},
+		Spec: v1alpha1.ImageClonePolicySpec{
+			DestinationRegistry: "team",
+			ExcludeImages:       []string{"quay.io/*"},
+			ResyncInterval:      &metav1.Duration{Duration: time.Hour},
+		},
+	}
+	c := fake.NewClientBuilder().WithScheme(policyScheme(t)).WithRuntimeObjects(dep, pol).Build()
+
+	rec := &DeploymentReconciler{
+		cl: c,
+		GenericReconciler: GenericReconciler{
+			RegClient:   &mockImgExistsReg{},
+			BuRegRemote: "test",
+			Policies:    true,
+		},
+	}
+	req := reconcile.Request{NamespacedName: types.NamespacedName{Name: "test", Namespace: "test"}}
+
+	res, err := rec.Reconcile(context.Background(), req)
+	if err != nil {
+		t.Errorf("Error: exp nil, got '%s'", err)
+	}
+	if res.RequeueAfter != time.Hour {
+		t.Errorf("Exp resync after '1h', got '%s'", res.RequeueAfter)
+	}
+
+	gotDep := &appsv1.Deployment{}
+	if err := c.Get(context.Background(), req.NamespacedName, gotDep); err != nil {
+		t.Fatalf("could not get deployment: '%v'", err)
+	}
+	if got := gotDep.Spec.Template.Spec.Containers[0].Image; got != "index.docker.io/team/simontheleg_debug-pod:latest" {
+		t.Errorf("Exp image 'index.docker.io/team/simontheleg_debug-pod:latest', got '%s'", got)
+	}
+	if got := gotDep.Spec.Template.Spec.Containers[1].Image; got != "quay.io/prometheus/node-exporter:v1.2.2" {
+		t.Errorf("Exp excluded image to be untouched, got '%s'", got)
+	}
+}
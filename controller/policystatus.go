@@ -0,0 +1,93 @@
+package controller
+
+import (
+	"context"
+
+	"github.com/simontheleg/image-clone-controller/api/v1alpha1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// PolicyReconciler reports the validity of ImageClonePolicies in their status
+type PolicyReconciler struct {
+	cl client.Client
+}
+
+func (r *PolicyReconciler) Reconcile(ctx context.Context, req reconcile.Request) (reconcile.Result, error) {
+	pol := &v1alpha1.ImageClonePolicy{}
+	if err := r.cl.Get(ctx, req.NamespacedName, pol); err != nil {
+		return reconcile.Result{}, client.IgnoreNotFound(err)
+	}
+	if !setValidCondition(&pol.Status.Conditions, pol.Generation, validatePolicy(&pol.Spec, true)) {
+		return reconcile.Result{}, nil
+	}
+	return reconcile.Result{}, r.cl.Status().Update(ctx, pol)
+}
+
+func (r *PolicyReconciler) InjectClient(c client.Client) error {
+	r.cl = c
+	return nil
+}
+
+func (r *PolicyReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&v1alpha1.ImageClonePolicy{}, builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+		Complete(r)
+}
+
+// ClusterPolicyReconciler reports the validity of ClusterImageClonePolicies in their status
+type ClusterPolicyReconciler struct {
+	cl client.Client
+}
+
+func (r *ClusterPolicyReconciler) Reconcile(ctx context.Context, req reconcile.Request) (reconcile.Result, error) {
+	pol := &v1alpha1.ClusterImageClonePolicy{}
+	if err := r.cl.Get(ctx, req.NamespacedName, pol); err != nil {
+		return reconcile.Result{}, client.IgnoreNotFound(err)
+	}
+	if !setValidCondition(&pol.Status.Conditions, pol.Generation, validatePolicy(&pol.Spec, false)) {
+		return reconcile.Result{}, nil
+	}
+	return reconcile.Result{}, r.cl.Status().Update(ctx, pol)
+}
+
+func (r *ClusterPolicyReconciler) InjectClient(c client.Client) error {
+	r.cl = c
+	return nil
+}
+
+func (r *ClusterPolicyReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&v1alpha1.ClusterImageClonePolicy{}, builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+		Complete(r)
+}
+
+// setValidCondition sets the ConditionValid condition according to the result of validating a policy.
+// It reports whether the conditions have changed
+func setValidCondition(conds *[]metav1.Condition, generation int64, err error) bool {
+	cond := metav1.Condition{
+		Type:               v1alpha1.ConditionValid,
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: generation,
+		Reason:             "Valid",
+		Message:            "Policy is valid",
+	}
+	if err != nil {
+		cond.Status = metav1.ConditionFalse
+		cond.Reason = "InvalidSpec"
+		cond.Message = err.Error()
+	}
+
+	old := meta.FindStatusCondition(*conds, v1alpha1.ConditionValid)
+	if old != nil && old.Status == cond.Status && old.Reason == cond.Reason && old.Message == cond.Message &&
+		old.ObservedGeneration == cond.ObservedGeneration {
+		return false
+	}
+	meta.SetStatusCondition(conds, cond)
+	return true
+}
@@ -0,0 +1,74 @@
+package controller
+
+import (
+	"context"
+	"testing"
+
+	"github.com/simontheleg/image-clone-controller/api/v1alpha1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+func TestPolicyReconciler(t *testing.T) {
+	tt := map[string]struct {
+		spec      v1alpha1.ImageClonePolicySpec
+		expStatus metav1.ConditionStatus
+		expReason string
+	}{
+		"valid": {
+			spec:      v1alpha1.ImageClonePolicySpec{IncludeImages: []string{"quay.io/*"}},
+			expStatus: metav1.ConditionTrue,
+			expReason: "Valid",
+		},
+		"invalid": {
+			spec:      v1alpha1.ImageClonePolicySpec{DestinationRegistry: "registry.example.com/backup/"},
+			expStatus: metav1.ConditionFalse,
+			expReason: "InvalidSpec",
+		},
+	}
+
+	for name, tc := range tt {
+		t.Run(name, func(t *testing.T) {
+			pol := &v1alpha1.ImageClonePolicy{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "policy", Generation: 2},
+				Spec:       tc.spec,
+			}
+			c := fake.NewClientBuilder().WithScheme(policyScheme(t)).WithRuntimeObjects(pol).Build()
+			rec := &PolicyReconciler{cl: c}
+			req := reconcile.Request{NamespacedName: types.NamespacedName{Namespace: "test", Name: "policy"}}
+
+			if _, err := rec.Reconcile(context.Background(), req); err != nil {
+				t.Fatalf("Error: exp nil, got '%s'", err)
+			}
+
+			got := &v1alpha1.ImageClonePolicy{}
+			if err := c.Get(context.Background(), req.NamespacedName, got); err != nil {
+				t.Fatalf("could not get policy: '%v'", err)
+			}
+			cond := meta.FindStatusCondition(got.Status.Conditions, v1alpha1.ConditionValid)
+			if cond == nil {
+				t.Fatal("Exp Valid condition to be set")
+			}
+			if cond.Status != tc.expStatus || cond.Reason != tc.expReason || cond.ObservedGeneration != 2 {
+				t.Errorf("Exp status '%s' with reason '%s' for generation 2, got %+v", tc.expStatus, tc.expReason, cond)
+			}
+
+			// reconciling again does not change the condition
+			if setValidCondition(&got.Status.Conditions, got.Generation, validatePolicy(&got.Spec, true)) {
+				t.Error("Exp condition to be unchanged")
+			}
+		})
+	}
+}
+
+func TestClusterPolicyReconcilerMissing(t *testing.T) {
+	c := fake.NewClientBuilder().WithScheme(policyScheme(t)).Build()
+	rec := &ClusterPolicyReconciler{cl: c}
+	req := reconcile.Request{NamespacedName: types.NamespacedName{Name: "default"}}
+	if _, err := rec.Reconcile(context.Background(), req); err != nil {
+		t.Errorf("Error: exp nil for deleted policy, got '%s'", err)
+	}
+}
@@ -1,14 +1,20 @@
 package controller
 
 import (
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/event"
 	"sigs.k8s.io/controller-runtime/pkg/predicate"
 )
 
-// We make use of a customer predicate for two reasons:
+// We make use of a customer predicate for four reasons:
 // 1. We do not want to reconcile on delete events
 // 2. We do not want to reconcile if the namespace is on the ignore list
-func contrPredicate(igns []string) predicate.Predicate {
+// 3. We do not want to reconcile workloads which opted out using the skip annotation
+// 4. We do not want to reconcile updates which did not change any images, see workloadChanged
+// igns is evaluated on every event, so the ignore list can change at runtime
+func contrPredicate(igns func() []string) predicate.Predicate {
 	contains := func(l []string, s string) bool {
 		for _, v := range l {
 			if v == s {
@@ -23,13 +29,72 @@ func contrPredicate(igns []string) predicate.Predicate {
 			return false
 		},
 		CreateFunc: func(ce event.CreateEvent) bool {
-			return !contains(igns, ce.Object.GetNamespace())
+			return !contains(igns(), ce.Object.GetNamespace()) && !skipWorkload(ce.Object)
 		},
 		UpdateFunc: func(ue event.UpdateEvent) bool {
-			return !contains(igns, ue.ObjectNew.GetNamespace())
+			return !contains(igns(), ue.ObjectNew.GetNamespace()) && !skipWorkload(ue.ObjectNew) && workloadChanged(ue)
 		},
 		GenericFunc: func(ge event.GenericEvent) bool {
-			return !contains(igns, ge.Object.GetNamespace())
+			return !contains(igns(), ge.Object.GetNamespace()) && !skipWorkload(ge.Object)
 		},
 	}
 }
+
+// workloadChanged reports whether an update event requires a reconcile. This is the case if:
+// - it is a periodic resync of the informer, which is delivered as an update without a new resource version
+// - the opt-out annotations changed, which do not increase the generation
+// - the generation changed and so did the image of any container of the pod template.
+// Status updates, scaling and our own patches of the annotations are dropped this way
+func workloadChanged(ue event.UpdateEvent) bool {
+	if ue.ObjectOld == nil || ue.ObjectNew == nil {
+		return true
+	}
+	if ue.ObjectOld.GetResourceVersion() == ue.ObjectNew.GetResourceVersion() {
+		return true
+	}
+	oldAnnos, newAnnos := ue.ObjectOld.GetAnnotations(), ue.ObjectNew.GetAnnotations()
+	if oldAnnos[skipAnnotation] != newAnnos[skipAnnotation] || oldAnnos[skipContainersAnnotation] != newAnnos[skipContainersAnnotation] {
+		return true
+	}
+	return predicate.GenerationChangedPredicate{}.Update(ue) && imagesChanged(ue.ObjectOld, ue.ObjectNew)
+}
+
+// imagesChanged reports whether the image of any container or init container differs between the pod templates of
+// both workloads. Unknown kinds always count as changed
+func imagesChanged(old, new client.Object) bool {
+	oldPts, newPts := podTemplate(old), podTemplate(new)
+	if oldPts == nil || newPts == nil {
+		return true
+	}
+	images := func(pts *corev1.PodTemplateSpec) map[string]string {
+		imgs := map[string]string{}
+		for _, cont := range pts.Spec.InitContainers {
+			imgs["init/"+cont.Name] = cont.Image
+		}
+		for _, cont := range pts.Spec.Containers {
+			imgs[cont.Name] = cont.Image
+		}
+		return imgs
+	}
+	oldImgs, newImgs := images(oldPts), images(newPts)
+	if len(oldImgs) != len(newImgs) {
+		return true
+	}
+	for n, img := range newImgs {
+		if oldImgs[n] != img {
+			return true
+		}
+	}
+	return false
+}
+
+// podTemplate returns the pod template of a workload supported by the controller
+func podTemplate(obj client.Object) *corev1.PodTemplateSpec {
+	switch o := obj.(type) {
+	case *appsv1.Deployment:
+		return &o.Spec.Template
+	case *appsv1.DaemonSet:
+		return &o.Spec.Template
+	}
+	return nil
+}
@@ -9,7 +9,7 @@ import (
 
 func TestContrPredicate(t *testing.T) {
 
-	pred := contrPredicate([]string{"kube-system"})
+	pred := contrPredicate(func() []string { return []string{"kube-system"} })
 
 	// Cases
 	// Namespace is on list
@@ -17,6 +17,7 @@ func TestContrPredicate(t *testing.T) {
 
 	tt := map[string]struct {
 		Ns    string
+		annos map[string]string
 		expDe bool
 		expCr bool
 		expUp bool
@@ -29,6 +30,14 @@ func TestContrPredicate(t *testing.T) {
 			expUp: false,
 			expGe: false,
 		},
+		"workload opted out": {
+			Ns:    "some-namespace",
+			annos: map[string]string{skipAnnotation: "true"},
+			expDe: false,
+			expCr: false,
+			expUp: false,
+			expGe: false,
+		},
 		"namespace should watch, except delete": {
 			Ns:    "some-namespace",
 			expDe: false,
@@ -43,6 +52,7 @@ func TestContrPredicate(t *testing.T) {
 		t.Run(name, func(t *testing.T) {
 			eventDe := event.DeleteEvent{Object: &appsv1.Deployment{}}
 			eventDe.Object.SetNamespace(tc.Ns)
+			eventDe.Object.SetAnnotations(tc.annos)
 			gotDe := pred.Delete(eventDe)
 			if gotDe != tc.expDe {
 				t.Errorf("DeleteEvent: not correct predicate - exp '%t' got '%t'", tc.expDe, gotDe)
@@ -50,6 +60,7 @@ func TestContrPredicate(t *testing.T) {
 
 			eventCr := event.CreateEvent{Object: &appsv1.Deployment{}}
 			eventCr.Object.SetNamespace(tc.Ns)
+			eventCr.Object.SetAnnotations(tc.annos)
 			gotCr := pred.Create(eventCr)
 			if gotCr != tc.expCr {
 				t.Errorf("CreateEvent: not correct predicate - exp '%t' got '%t'", tc.expCr, gotCr)
@@ -57,6 +68,7 @@ func TestContrPredicate(t *testing.T) {
 
 			eventUp := event.UpdateEvent{ObjectNew: &appsv1.Deployment{}}
 			eventUp.ObjectNew.SetNamespace(tc.Ns)
+			eventUp.ObjectNew.SetAnnotations(tc.annos)
 			gotUp := pred.Update(eventUp)
 			if gotUp != tc.expUp {
 				t.Errorf("UpdateEvent: not correct predicate - exp '%t' got '%t'", tc.expUp, gotUp)
@@ -64,6 +76,7 @@ func TestContrPredicate(t *testing.T) {
 
 			eventGe := event.GenericEvent{Object: &appsv1.Deployment{}}
 			eventGe.Object.SetNamespace(tc.Ns)
+			eventGe.Object.SetAnnotations(tc.annos)
 			gotGe := pred.Generic(eventGe)
 			if gotGe != tc.expGe {
 				t.Errorf("GeeateEvent: not correct predicate - exp '%t' got '%t'", tc.expGe, gotGe)
@@ -73,3 +86,64 @@ func TestContrPredicate(t *testing.T) {
 
 	}
 }
+
+func TestWorkloadChanged(t *testing.T) {
+	dep := func(rv string, gen int64, annos map[string]string, imgs ...string) *appsv1.Deployment {
+		d := depFromImages(imgs, []string{"istio/proxy_init:1.0.2"}, "test", "test")
+		d.ResourceVersion = rv
+		d.Generation = gen
+		d.Annotations = annos
+		return d
+	}
+
+	tt := map[string]struct {
+		old *appsv1.Deployment
+		new *appsv1.Deployment
+		exp bool
+	}{
+		"resync": {
+			old: dep("1", 1, nil, "nginx:1.21"),
+			new: dep("1", 1, nil, "nginx:1.21"),
+			exp: true,
+		},
+		"status update": {
+			old: dep("1", 1, nil, "nginx:1.21"),
+			new: dep("2", 1, nil, "nginx:1.21"),
+			exp: false,
+		},
+		"scaled": {
+			old: dep("1", 1, nil, "nginx:1.21"),
+			new: dep("2", 2, nil, "nginx:1.21"),
+			exp: false,
+		},
+		"image changed": {
+			old: dep("1", 1, nil, "nginx:1.21"),
+			new: dep("2", 2, nil, "nginx:1.22"),
+			exp: true,
+		},
+		"container added": {
+			old: dep("1", 1, nil, "nginx:1.21"),
+			new: dep("2", 2, nil, "nginx:1.21", "busybox:1.34"),
+			exp: true,
+		},
+		"opt out removed": {
+			old: dep("1", 1, map[string]string{skipContainersAnnotation: "container-0"}, "nginx:1.21"),
+			new: dep("2", 1, nil, "nginx:1.21"),
+			exp: true,
+		},
+		"other annotation changed": {
+			old: dep("1", 1, nil, "nginx:1.21"),
+			new: dep("2", 1, map[string]string{originalImagesAnnotation: "{}"}, "nginx:1.21"),
+			exp: false,
+		},
+	}
+
+	for name, tc := range tt {
+		t.Run(name, func(t *testing.T) {
+			got := workloadChanged(event.UpdateEvent{ObjectOld: tc.old, ObjectNew: tc.new})
+			if got != tc.exp {
+				t.Errorf("Exp '%t', got '%t'", tc.exp, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// RestoreOptions select which workloads are restored
+type RestoreOptions struct {
+	// Namespace to restore workloads in. Empty means all namespaces
+	Namespace string
+	// Selector for the labels of workloads. Nil selects all workloads
+	Selector labels.Selector
+	// Only compute which images would be restored without patching any workloads
+	DryRun bool
+	// Backup registry and separator the workloads were rewritten with. Only containers still running the backup of
+	// their original image are restored
+	BackupRegistry string
+	Separator      string
+}
+
+// RestoredWorkload describes the images restored for a single workload
+type RestoredWorkload struct {
+	Kind      string
+	Namespace string
+	Name      string
+	// Diff lists the restored images as "container: backup -> original"
+	Diff []string
+	// Skipped lists containers whose image changed since they were rewritten as "container: image"
+	Skipped []string
+	Err     error
+}
+
+// Restore reverts all Deployments and DaemonSets selected by opts to the original images recorded in their
+// originalImagesAnnotation and removes the annotation. Workloads without the annotation are left untouched, as are
+// containers whose image changed since they were rewritten, e.g. by deploying a new version.
+// Make sure the controller is not running at the same time, otherwise it will rewrite the workloads again.
+func Restore(ctx context.Context, cl client.Client, opts RestoreOptions) ([]RestoredWorkload, error) {
+	listOpts := []client.ListOption{client.InNamespace(opts.Namespace)}
+	if opts.Selector != nil {
+		listOpts = append(listOpts, client.MatchingLabelsSelector{Selector: opts.Selector})
+	}
+
+	res := []RestoredWorkload{}
+
+	deps := &appsv1.DeploymentList{}
+	if err := cl.List(ctx, deps, listOpts...); err != nil {
+		return res, err
+	}
+	for i := range deps.Items {
+		if rw, ok := restoreWorkload(ctx, cl, &deps.Items[i], "Deployment", opts); ok {
+			res = append(res, rw)
+		}
+	}
+
+	dss := &appsv1.DaemonSetList{}
+	if err := cl.List(ctx, dss, listOpts...); err != nil {
+		return res, err
+	}
+	for i := range dss.Items {
+		if rw, ok := restoreWorkload(ctx, cl, &dss.Items[i], "DaemonSet", opts); ok {
+			res = append(res, rw)
+		}
+	}
+
+	return res, nil
+}
+
+// restoreWorkload restores the images of a workload supported by podTemplate. It returns false if there was nothing to restore.
+// If the workload changed since obj was read, it is read again and the restore is computed from its current state
+func restoreWorkload(ctx context.Context, cl client.Client, obj client.Object, kind string, opts RestoreOptions) (rw RestoredWorkload, restored bool) {
+	first := true
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		if !first {
+			if err := cl.Get(ctx, client.ObjectKeyFromObject(obj), obj); err != nil {
+				return err
+			}
+		}
+		first = false
+		rw, restored = restoreWorkloadOnce(ctx, cl, obj, kind, opts)
+		return rw.Err
+	})
+	rw.Err = err
+	return rw, restored
+}
+
+// restoreWorkloadOnce works like restoreWorkload, but fails with a conflict if the workload changed since obj was read.
+// obj is left intact
+func restoreWorkloadOnce(ctx context.Context, cl client.Client, obj client.Object, kind string, opts RestoreOptions) (RestoredWorkload, bool) {
+	obj = obj.DeepCopyObject().(client.Object)
+	tmpl := podTemplate(obj)
+	rw := RestoredWorkload{Kind: kind, Namespace: obj.GetNamespace(), Name: obj.GetName()}
+
+	if _, ok := tmpl.Annotations[originalImagesAnnotation]; !ok {
+		if _, ok := obj.GetAnnotations()[originalImagesAnnotation]; !ok {
+			return rw, false
+		}
+	}
+	origs := originalImages(ctx, tmpl)
+	if len(origs) == 0 {
+		// the annotation on the template is authoritative, but might have been removed manually
+		origs = originalImages(ctx, obj)
+	}
+
+	oldObj := obj.DeepCopyObject().(client.Object)
+	oldTmpl := tmpl.DeepCopy()
+
+	r := &GenericReconciler{BuRegRemote: opts.BackupRegistry, Separator: opts.Separator}
+	restoreContainers := func(conts []corev1.Container) {
+		for p, cont := range conts {
+			orig, ok := origs[cont.Name]
+			switch {
+			case !ok || orig.Image == cont.Image:
+			case r.isBackupOf(cont.Image, orig.Image):
+				rw.Diff = append(rw.Diff, fmt.Sprintf("%s: %s -> %s", cont.Name, cont.Image, orig.Image))
+				conts[p].Image = orig.Image
+			default:
+				rw.Skipped = append(rw.Skipped, fmt.Sprintf("%s: %s", cont.Name, cont.Image))
+			}
+		}
+	}
+	restoreContainers(tmpl.Spec.InitContainers)
+	restoreContainers(tmpl.Spec.Containers)
+	setAnnotation(tmpl, originalImagesAnnotation, "")
+	setAnnotation(obj, originalImagesAnnotation, "")
+
+	if opts.DryRun {
+		return rw, true
+	}
+
+	patch, err := workloadPatch(oldObj, obj, oldTmpl, tmpl)
+	if err != nil {
+		rw.Err = err
+		return rw, true
+	}
+	rw.Err = cl.Patch(ctx, obj, client.RawPatch(types.StrategicMergePatchType, patch), client.FieldOwner(fieldManager))
+	return rw, true
+}
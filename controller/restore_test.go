@@ -0,0 +1,125 @@
+package controller
+
+import (
+	"context"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestRestore(t *testing.T) {
+	tt := map[string]struct {
+		opts       RestoreOptions
+		image      string
+		expRestore bool
+		expSkipped bool
+		expImage   string
+	}{
+		"restore all": {
+			opts:       RestoreOptions{},
+			expRestore: true,
+			expImage:   "simontheleg/debug-pod:latest",
+		},
+		"dry run": {
+			opts:       RestoreOptions{DryRun: true},
+			expRestore: true,
+			expImage:   "index.docker.io/test/simontheleg_debug-pod:latest",
+		},
+		"other namespace": {
+			opts:       RestoreOptions{Namespace: "other"},
+			expRestore: false,
+			expImage:   "index.docker.io/test/simontheleg_debug-pod:latest",
+		},
+		"not matching selector": {
+			opts:       RestoreOptions{Selector: labels.SelectorFromSet(labels.Set{"app": "other"})},
+			expRestore: false,
+			expImage:   "index.docker.io/test/simontheleg_debug-pod:latest",
+		},
+		"image changed after the rewrite": {
+			opts:       RestoreOptions{},
+			image:      "simontheleg/debug-pod:v2",
+			expRestore: true,
+			expSkipped: true,
+			expImage:   "simontheleg/debug-pod:v2",
+		},
+	}
+
+	for name, tc := range tt {
+		t.Run(name, func(t *testing.T) {
+			img := "index.docker.io/test/simontheleg_debug-pod:latest"
+			if tc.image != "" {
+				img = tc.image
+			}
+			dep := depFromImages([]string{img}, []string{}, "test", "test")
+			dep.Labels = map[string]string{"app": "test"}
+			origs := `{"container-0":{"image":"simontheleg/debug-pod:latest","backupTime":"2021-09-01T00:00:00Z"}}`
+			dep.Annotations = map[string]string{originalImagesAnnotation: origs}
+			dep.Spec.Template.Annotations = map[string]string{originalImagesAnnotation: origs}
+			untouched := depFromImages([]string{"nginx:latest"}, []string{}, "untouched", "test")
+
+			c := fake.NewClientBuilder().WithRuntimeObjects(dep, untouched).Build()
+
+			tc.opts.BackupRegistry = "test"
+			res, err := Restore(context.Background(), c, tc.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.expRestore != (len(res) == 1) {
+				t.Fatalf("Exp restore '%t', got %v", tc.expRestore, res)
+			}
+			if tc.expRestore && !tc.expSkipped && (res[0].Name != "test" || len(res[0].Diff) != 1 || res[0].Err != nil) {
+				t.Errorf("Exp deployment 'test' with one restored image, got %+v", res[0])
+			}
+			if tc.expSkipped && (len(res[0].Diff) != 0 || len(res[0].Skipped) != 1 || res[0].Err != nil) {
+				t.Errorf("Exp deployment 'test' with one skipped container, got %+v", res[0])
+			}
+
+			gotDep := &appsv1.Deployment{}
+			if err := c.Get(context.Background(), types.NamespacedName{Name: "test", Namespace: "test"}, gotDep); err != nil {
+				t.Fatalf("could not get deployment: '%v'", err)
+			}
+			if got := gotDep.Spec.Template.Spec.Containers[0].Image; got != tc.expImage {
+				t.Errorf("Containers: Exp image '%s', got '%s'", tc.expImage, got)
+			}
+			_, hasAnno := gotDep.Spec.Template.Annotations[originalImagesAnnotation]
+			if restored := tc.expRestore && !tc.opts.DryRun; hasAnno == restored {
+				t.Errorf("Exp original images annotation to be removed '%t', but is present '%t'", restored, hasAnno)
+			}
+		})
+	}
+}
+
+func TestRestoreWorkloadConflict(t *testing.T) {
+	dep := depFromImages([]string{"index.docker.io/test/simontheleg_debug-pod:latest"}, []string{}, "test", "test")
+	origs := `{"container-0":{"image":"simontheleg/debug-pod:latest","backupTime":"2021-09-01T00:00:00Z"}}`
+	dep.Spec.Template.Annotations = map[string]string{originalImagesAnnotation: origs}
+	c := fake.NewClientBuilder().WithRuntimeObjects(dep).Build()
+
+	stale := &appsv1.Deployment{}
+	if err := c.Get(context.Background(), types.NamespacedName{Name: "test", Namespace: "test"}, stale); err != nil {
+		t.Fatal(err)
+	}
+	// the workload is changed to a different image and rewritten to its backup after it was read
+	cur := stale.DeepCopy()
+	cur.Spec.Template.Spec.Containers[0].Image = "index.docker.io/test/library_nginx:latest"
+	cur.Spec.Template.Annotations[originalImagesAnnotation] = `{"container-0":{"image":"nginx:latest","backupTime":"2021-09-02T00:00:00Z"}}`
+	if err := c.Update(context.Background(), cur); err != nil {
+		t.Fatal(err)
+	}
+
+	rw, ok := restoreWorkload(context.Background(), c, stale, "Deployment", RestoreOptions{BackupRegistry: "test"})
+	if !ok || rw.Err != nil || len(rw.Diff) != 1 {
+		t.Fatalf("Exp one restored image, got '%t', %+v", ok, rw)
+	}
+
+	got := &appsv1.Deployment{}
+	if err := c.Get(context.Background(), types.NamespacedName{Name: "test", Namespace: "test"}, got); err != nil {
+		t.Fatal(err)
+	}
+	if img := got.Spec.Template.Spec.Containers[0].Image; img != "nginx:latest" {
+		t.Errorf("Exp the current original image to be restored, got '%s'", img)
+	}
+}
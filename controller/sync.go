@@ -0,0 +1,110 @@
+package controller
+
+import (
+	"context"
+
+	appsv1 "k8s.io/api/apps/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// SyncOptions select which workloads are synced
+type SyncOptions struct {
+	// Namespace to sync workloads in. Empty means all namespaces
+	Namespace string
+	// Progress is called after each workload, with the number of workloads done and in total. Optional
+	Progress func(done, total int, res SyncResult)
+}
+
+// SyncResult describes the outcome of syncing a single workload
+type SyncResult struct {
+	Kind      string
+	Namespace string
+	Name      string
+	// Diff lists the rewritten images as "container: original -> backup". In ModeAudit they are only reported
+	Diff []string
+	// Audit is set if the workload was only audited, either because of the mode or a policy
+	Audit bool
+	// Reason the workload was skipped, empty if it was synced
+	Skipped string
+	Err     error
+}
+
+// Sync backs up the images of all Deployments and DaemonSets selected by opts and rewrites them, the same way the
+// reconcilers would, and returns once all workloads have been processed. Namespaces which are not watched, opted out
+// workloads and policies are honored. Errors of single workloads are reported in their SyncResult
+func Sync(ctx context.Context, cl client.Client, r *GenericReconciler, opts SyncOptions) ([]SyncResult, error) {
+	wls, err := listWorkloads(ctx, cl, opts.Namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]SyncResult, 0, len(wls))
+	for i, wl := range wls {
+		sr := r.syncWorkload(ctx, cl, wl.obj, wl.kind)
+		res = append(res, sr)
+		if opts.Progress != nil {
+			opts.Progress(i+1, len(wls), sr)
+		}
+	}
+	return res, nil
+}
+
+// workload is a Deployment or DaemonSet
+type workload struct {
+	kind string
+	obj  client.Object
+}
+
+// listWorkloads returns all Deployments and DaemonSets in namespace. An empty namespace means all namespaces
+func listWorkloads(ctx context.Context, cl client.Reader, namespace string) ([]workload, error) {
+	deps := &appsv1.DeploymentList{}
+	if err := cl.List(ctx, deps, client.InNamespace(namespace)); err != nil {
+		return nil, err
+	}
+	dss := &appsv1.DaemonSetList{}
+	if err := cl.List(ctx, dss, client.InNamespace(namespace)); err != nil {
+		return nil, err
+	}
+
+	wls := []workload{}
+	for i := range deps.Items {
+		wls = append(wls, workload{"Deployment", &deps.Items[i]})
+	}
+	for i := range dss.Items {
+		wls = append(wls, workload{"DaemonSet", &dss.Items[i]})
+	}
+	return wls, nil
+}
+
+// syncWorkload runs the same steps as a reconcile for a single workload
+func (r *GenericReconciler) syncWorkload(ctx context.Context, cl client.Client, obj client.Object, kind string) SyncResult {
+	sr := SyncResult{Kind: kind, Namespace: obj.GetNamespace(), Name: obj.GetName()}
+
+	watched, err := r.watchesNamespace(ctx, cl, obj.GetNamespace())
+	if err != nil {
+		sr.Err = err
+		return sr
+	}
+	if !watched {
+		sr.Skipped = "namespace not watched"
+		return sr
+	}
+	if skipWorkload(obj) {
+		sr.Skipped = "opted out"
+		return sr
+	}
+	g, err := r.policyFor(ctx, cl, obj.GetNamespace())
+	if err != nil {
+		sr.Err = err
+		return sr
+	}
+
+	sr.Audit = g.Mode == ModeAudit
+	diff, buErr, err := g.rewriteWorkload(ctx, cl, obj, kind)
+	sr.Diff = diff
+	sr.Err = err
+	if sr.Err == nil {
+		sr.Err = buErr
+	}
+	return sr
+}
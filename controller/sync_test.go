@@ -0,0 +1,57 @@
+package controller
+
+import (
+	"context"
+	"testing"
+
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestSync(t *testing.T) {
+	optedOut := depFromImages([]string{"nginx:1.21"}, nil, "opted-out", "test")
+	optedOut.Annotations = map[string]string{skipAnnotation: "true"}
+	c := fake.NewClientBuilder().WithRuntimeObjects(
+		depFromImages([]string{"nginx:1.21"}, nil, "dep", "test"),
+		depFromImages([]string{"nginx:1.21"}, nil, "ignored", "kube-system"),
+		optedOut,
+		dsFromImages([]string{"img-a:1", "img-b:1"}, nil, "ds", "test"),
+	).Build()
+
+	r := &GenericReconciler{
+		Igns:        []string{"kube-system"},
+		RegClient:   &mockSlowReg{failImage: "index.docker.io/library/img-b:1"},
+		BuRegRemote: "test",
+	}
+	progress := 0
+	res, err := Sync(context.Background(), c, r, SyncOptions{
+		Progress: func(done, total int, res SyncResult) {
+			progress++
+			if done != progress || total != 4 {
+				t.Errorf("Exp progress %d/4, got %d/%d", progress, done, total)
+			}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 4 {
+		t.Fatalf("Exp 4 results, got %d", len(res))
+	}
+
+	got := map[string]SyncResult{}
+	for _, sr := range res {
+		got[sr.Kind+"/"+sr.Name] = sr
+	}
+	if sr := got["Deployment/dep"]; sr.Err != nil || len(sr.Diff) != 1 {
+		t.Errorf("Exp Deployment to be rewritten, got %+v", sr)
+	}
+	if sr := got["Deployment/ignored"]; sr.Skipped != "namespace not watched" {
+		t.Errorf("Exp ignored namespace to be skipped, got %+v", sr)
+	}
+	if sr := got["Deployment/opted-out"]; sr.Skipped != "opted out" {
+		t.Errorf("Exp opted out Deployment to be skipped, got %+v", sr)
+	}
+	if sr := got["DaemonSet/ds"]; sr.Err == nil {
+		t.Errorf("Exp failed backup to be reported, got %+v", sr)
+	}
+}
@@ -0,0 +1,31 @@
+package controller
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+var tracer = otel.Tracer("github.com/simontheleg/image-clone-controller/controller")
+
+// startReconcileSpan starts the root span of a reconcile of the workload of kind
+func startReconcileSpan(ctx context.Context, kind string, req reconcile.Request) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "Reconcile "+kind, trace.WithAttributes(
+		attribute.String("kind", kind),
+		attribute.String("namespace", req.Namespace),
+		attribute.String("name", req.Name),
+	))
+}
+
+// endSpan records err on span and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
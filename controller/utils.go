@@ -2,86 +2,460 @@ package controller
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/google/go-containerregistry/pkg/name"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/simontheleg/image-clone-controller/auditlog"
 	"github.com/simontheleg/image-clone-controller/registry"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 )
 
+// rateLimitBackoff is how long we wait before retrying, once a registry told us to slow down
+const rateLimitBackoff = 5 * time.Minute
+
 type BackUPer struct {
 	Reg   registry.BackUp
 	DAuth authn.Authenticator
+	// Only compute the backup reference without checking or copying the image
+	SkipCopy bool
+	// Separator for nested repositories in backup references. Defaults to registry.DefaultSeparator
+	Separator string
+	// Recorder and Obj are optional. If set, Events about the backups are recorded on Obj
+	Recorder record.EventRecorder
+	Obj      runtime.Object
+	// Record backups as ImageBackups using this client. Nil disables the inventory
+	Inventory client.Client
+	// Record copies in this audit log. Nil disables it
+	AuditLog auditlog.Sink
 }
 
-func (b *BackUPer) ensureBackup(ctx context.Context, image string, newReg string) (newImage string, err error) {
+// ensureBackup ensures a backup of image exists in newReg and returns its reference. The digest of the original image is
+// only known if it was copied by this call
+func (b *BackUPer) ensureBackup(ctx context.Context, image string, newReg string) (bu backup, err error) {
+	ctx, span := tracer.Start(ctx, "ensureBackup", trace.WithAttributes(attribute.String("image", image)))
 	log := log.FromContext(ctx)
 
+	defer func() {
+		span.SetAttributes(attribute.String("backup", bu.ref))
+		endSpan(span, err)
+		if err != nil {
+			b.event(corev1.EventTypeWarning, "BackupFailed", "Backup of image %s failed: %v", image, err)
+			b.audit(ctx, auditlog.Entry{Action: auditlog.ActionCopyFailed, Source: image, Error: err.Error()})
+		}
+	}()
+
 	orgRef, err := name.ParseReference(image)
 	if err != nil {
-		return "", err
+		return backup{}, err
 	}
-	buRef, err := name.ParseReference(registry.GenBackUpReference(newReg, orgRef))
+	buRef, err := name.ParseReference(backUpReference(newReg, orgRef, b.Separator))
 	if err != nil {
-		return "", err
+		return backup{}, err
+	}
+	// backups of digest references are tagged with the original digest, but pinned to their own one
+	_, pinned := orgRef.(name.Digest)
+	if pinned && orgRef.Context().Name() == buRef.Context().Name() {
+		return backup{ref: orgRef.Name()}, nil
+	}
+	if b.SkipCopy {
+		backupsSkippedTotal.WithLabelValues("audit").Inc()
+		return backup{ref: buRef.Name()}, nil
 	}
 
-	exists, err := b.Reg.ReferenceExists(buRef, remote.WithAuth(b.DAuth))
+	buDigest, exists, err := b.Reg.ReferenceExists(ctx, buRef, remote.WithAuth(b.DAuth))
 	if err != nil {
-		return "", err
+		return backup{}, err
 	}
 	if exists {
-		log.Info("Image already exists in remote. No need to copy", "image", buRef.Context().RepositoryStr(), "remote", buRef.Context().RegistryStr())
+		// this is the common case on every resync, so it is neither logged by default nor recorded as an Event
+		log.V(1).Info("Image already exists in remote. No need to copy", "image", buRef.Context().RepositoryStr(), "remote", buRef.Context().RegistryStr())
+		backupsSkippedTotal.WithLabelValues("exists").Inc()
+		bu.backupDigest = buDigest
 	} else {
 		log.Info("Creating backup for image", "orig", orgRef.Context().RepositoryStr(), "backup", buRef.Context().RepositoryStr())
-		err := b.Reg.BackUpImage(orgRef, buRef, nil, []remote.Option{remote.WithAuth(b.DAuth)})
+		b.event(corev1.EventTypeNormal, "BackupStarted", "Backing up image %s to %s", orgRef.Name(), buRef.Name())
+		c, err := b.Reg.BackUpImage(ctx, orgRef, buRef, nil, []remote.Option{remote.WithAuth(b.DAuth)})
 		if err != nil {
-			return "", err
+			return backup{}, err
 		}
+		// the digest of the copied manifest describes the backup, unlike the one the tag might have moved on to since
+		bu.digest = c.SourceDigest
+		bu.backupDigest = c.BackupDigest
+		b.event(corev1.EventTypeNormal, "BackupCompleted", "Backed up image %s to %s", orgRef.Name(), buRef.Name())
+	}
+	// the inventory is informational, so failing to record the backup does not fail it
+	if err := b.recordBackup(ctx, orgRef, buRef, bu.digest, bu.backupDigest, !exists); err != nil {
+		log.Error(err, "Could not record backup in inventory", "backup", buRef.Name())
+	}
+	// images already pointing to their backup are not substituted, so they are not audited
+	if b.AuditLog != nil && orgRef.Name() != buRef.Name() {
+		action := auditlog.ActionCopied
+		if exists {
+			action = auditlog.ActionExists
+		}
+		b.audit(ctx, auditlog.Entry{Action: action, Source: orgRef.Name(), SourceDigest: bu.digest, Backup: buRef.Name(), BackupDigest: bu.backupDigest})
 	}
 
 	log.Info("Successfully finished backup", "image", buRef.Context().RepositoryStr(), "remote", buRef.Context().RegistryStr())
-	return buRef.Name(), nil
+	bu.ref = buRef.Name()
+	if pinned {
+		// filtering platforms changes the digest, so the workload is pinned to the one of the backup
+		bu.ref = buRef.Context().Digest(bu.backupDigest).Name()
+	}
+	return bu, nil
 }
 
+// backUpReference generates the backup reference of ref, using the default separator if sep is empty
+func backUpReference(reg string, ref name.Reference, sep string) string {
+	if sep == "" {
+		sep = registry.DefaultSeparator
+	}
+	return registry.GenBackUpReferenceWithSeparator(reg, ref, sep)
+}
+
+func (b *BackUPer) event(eventtype, reason, messageFmt string, args ...interface{}) {
+	if b.Recorder == nil || b.Obj == nil {
+		return
+	}
+	b.Recorder.Eventf(b.Obj, eventtype, reason, messageFmt, args...)
+}
+
+// Mode controls whether reconcilers are allowed to modify workloads
+type Mode string
+
+const (
+	// ModeEnforce backs up images and rewrites workloads
+	ModeEnforce Mode = "enforce"
+	// ModeAudit only reports which images would be rewritten, but never modifies workloads
+	ModeAudit Mode = "audit"
+)
+
+// defaultMaxConcurrentBackups is used if GenericReconciler.MaxConcurrentBackups is not set
+const defaultMaxConcurrentBackups = 4
+
 type GenericReconciler struct {
-	Igns        []string
-	RegClient   registry.BackUp
-	DAuth       authn.Authenticator
-	BuRegRemote string
+	// Namespaces to ignore
+	Igns []string
+	// Only watch namespaces matching NsSelector. Nil selects all namespaces
+	NsSelector labels.Selector
+	// Ignore namespaces matching NsExcludeSelector. Nil excludes no namespaces
+	NsExcludeSelector labels.Selector
+	RegClient         registry.BackUp
+	DAuth             authn.Authenticator
+	BuRegRemote       string
+	// Separator for nested repositories in backup references. Defaults to registry.DefaultSeparator
+	Separator string
+	// Maximum number of images which are backed up in parallel during a single reconcile
+	MaxConcurrentBackups int
+	// Rewrite all containers which could be backed up, even if backups for others failed
+	PartialRewrite bool
+	// Mode defaults to ModeEnforce if empty
+	Mode Mode
+	// Still copy images in ModeAudit
+	AuditCopy bool
+	// Only compute backup references without checking or copying images, e.g. for dry runs. Implied by ModeAudit
+	// without AuditCopy
+	SkipCopy bool
+	Recorder record.EventRecorder
+	// Look up ImageClonePolicies and ClusterImageClonePolicies at reconcile time and apply them on top of this configuration
+	Policies bool
+	// Only back up images matching any of these patterns. Empty selects all images
+	IncludeImages []string
+	// Never back up or rewrite images matching any of these patterns
+	ExcludeImages []string
+	// Reconcile workloads again after this interval. Zero disables resyncs
+	ResyncInterval time.Duration
+	// Record backups as ImageBackups using this client. Nil disables the inventory
+	Inventory client.Client
+	// Record copies and rewrites in this audit log. Nil disables it
+	AuditLog auditlog.Sink
+	// Live configuration replacing all of the above if set. Allows to reconfigure running reconcilers
+	Live *LiveReconciler
 }
 
 // patchPodSpecAndImage ensures that images are backed up and returns a patched PodTemplateSpec.
-// It will leave the old object intact and return a pointer to a patched copy
-func (r *GenericReconciler) patchPodSpecAndImage(ctx context.Context, old corev1.PodTemplateSpec) (patchReq bool, upd *corev1.PodTemplateSpec, err error) {
-	bu := BackUPer{
-		Reg:   r.RegClient,
-		DAuth: r.DAuth,
+// Images are backed up concurrently and the PodTemplateSpec is only patched once all backups have completed.
+// By default the first failing backup aborts the patch. With PartialRewrite, all containers are attempted,
+// successful ones are patched and the failed ones are returned as BackupErrors alongside the patched copy.
+// The original image of every rewritten container is recorded in the originalImagesAnnotation of the PodTemplateSpec.
+// obj is the workload owning the PodTemplateSpec. Events about the backups are recorded on it and containers listed
+// in its skipContainersAnnotation, as well as containers whose images are not selected by IncludeImages and ExcludeImages,
+// are left untouched.
+// It will leave the old object intact and return a pointer to a patched copy, together with the rewritten containers.
+// Rewrites are not audited, as the caller has yet to apply them
+func (r *GenericReconciler) patchPodSpecAndImage(ctx context.Context, obj client.Object, old corev1.PodTemplateSpec) (patchReq bool, upd *corev1.PodTemplateSpec, rws []containerRewrite, err error) {
+	upd = old.DeepCopy()
+
+	optOut := skippedContainers(obj)
+	skip := func(cont corev1.Container) bool {
+		return optOut[cont.Name] || !r.selectsImage(cont.Image)
+	}
+	images := podImages(upd, skip)
+	bus := r.backUpImages(ctx, obj, images)
+	if !r.PartialRewrite {
+		// report errors in the order of the containers, so the same error is reported on every attempt
+		for _, img := range images {
+			if bu, ok := bus[img]; ok && bu.err != nil {
+				return false, nil, nil, bu.err
+			}
+		}
 	}
 
-	upd = &old
-	for p, cont := range old.Spec.InitContainers {
-		ref, err := bu.ensureBackup(ctx, cont.Image, r.BuRegRemote)
-		if old.Spec.InitContainers[p].Image != ref {
-			patchReq = true
-			upd.Spec.InitContainers[p].Image = ref
+	origs := originalImages(ctx, &old)
+	newOrigs := map[string]OriginalImage{}
+	now := metav1.Now()
+
+	var buErrs BackupErrors
+	patchContainers := func(conts []corev1.Container) {
+		for p, cont := range conts {
+			if skip(cont) {
+				if orig, ok := origs[cont.Name]; ok && r.isBackupOf(cont.Image, orig.Image) {
+					newOrigs[cont.Name] = orig
+				}
+				continue
+			}
+			bu := bus[cont.Image]
+			if bu.err != nil {
+				buErrs = append(buErrs, ContainerError{Container: cont.Name, Image: cont.Image, Err: bu.err})
+				continue
+			}
+			if bu.ref != cont.Image {
+				patchReq = true
+				conts[p].Image = bu.ref
+				newOrigs[cont.Name] = OriginalImage{Image: cont.Image, Digest: bu.originalDigest(), BackupTime: now}
+				rws = append(rws, containerRewrite{container: cont, bu: bu})
+			} else if orig, ok := origs[cont.Name]; ok && r.isBackupOf(cont.Image, orig.Image) {
+				newOrigs[cont.Name] = orig
+			}
 		}
-		if err != nil {
-			return false, nil, err
+	}
+	patchContainers(upd.Spec.InitContainers)
+	patchContainers(upd.Spec.Containers)
+
+	if setOriginalImages(upd, newOrigs) {
+		patchReq = true
+	}
+
+	if len(buErrs) > 0 {
+		return patchReq, upd, rws, buErrs
+	}
+	return patchReq, upd, rws, nil
+}
+
+// isBackupOf reports whether image is the backup reference of orig. Backups of digest references match any digest of
+// the backup repository, as the digest of the backup may differ from the original one
+func (r *GenericReconciler) isBackupOf(image, orig string) bool {
+	imgRef, err := name.ParseReference(image)
+	if err != nil {
+		return false
+	}
+	origRef, err := name.ParseReference(orig)
+	if err != nil {
+		return false
+	}
+	buRef, err := name.ParseReference(backUpReference(r.BuRegRemote, origRef, r.Separator))
+	if err != nil {
+		return false
+	}
+	if _, ok := origRef.(name.Digest); ok {
+		_, ok := imgRef.(name.Digest)
+		return ok && imgRef.Context().Name() == buRef.Context().Name()
+	}
+	return imgRef.Name() == buRef.Name()
+}
+
+// backup is the result of backing up a single image
+type backup struct {
+	// reference of the backup
+	ref string
+	// digest of the original image, only set if it was copied
+	digest string
+	// digest of the backup, unless copying was skipped
+	backupDigest string
+	err          error
+}
+
+// originalDigest returns the digest of the original image. For backups which already existed, it is the digest of the
+// backup, which only differs from the original one if platforms of an index were filtered
+func (bu backup) originalDigest() string {
+	if bu.digest != "" {
+		return bu.digest
+	}
+	return bu.backupDigest
+}
+
+// backUpImages ensures backups for all images with at most MaxConcurrentBackups running at the same time.
+// It returns the result of every backup by image.
+// Unless PartialRewrite is set, all remaining backups are cancelled on the first error
+func (r *GenericReconciler) backUpImages(ctx context.Context, obj runtime.Object, images []string) map[string]backup {
+	bu := BackUPer{
+		Reg:       r.RegClient,
+		DAuth:     r.DAuth,
+		SkipCopy:  r.SkipCopy || (r.Mode == ModeAudit && !r.AuditCopy),
+		Separator: r.Separator,
+		Recorder:  r.Recorder,
+		Obj:       obj,
+		Inventory: r.Inventory,
+		AuditLog:  r.AuditLog,
+	}
+
+	limit := r.MaxConcurrentBackups
+	if limit <= 0 {
+		limit = defaultMaxConcurrentBackups
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		aborted bool
+		bus     = make(map[string]backup, len(images))
+		sem     = make(chan struct{}, limit)
+	)
+	for _, img := range images {
+		wg.Add(1)
+		go func(img string) {
+			defer wg.Done()
+
+			var res backup
+			select {
+			case sem <- struct{}{}:
+				res, res.err = bu.ensureBackup(ctx, img, r.BuRegRemote)
+				<-sem
+			case <-ctx.Done():
+				res.err = ctx.Err()
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if res.err != nil && aborted {
+				// remaining errors are only a consequence of us cancelling the context
+				return
+			}
+			bus[img] = res
+			if res.err != nil && !r.PartialRewrite {
+				aborted = true
+				cancel()
+			}
+		}(img)
+	}
+	wg.Wait()
+
+	return bus
+}
+
+// ReadyzCheck reports the controller as ready, once the backup registry is reachable with the configured credentials
+func (r *GenericReconciler) ReadyzCheck(req *http.Request) error {
+	r = r.current()
+	repo, err := name.NewRepository(strings.TrimSuffix(r.BuRegRemote, "/"))
+	if err != nil {
+		return err
+	}
+	return registry.Ping(req.Context(), repo, r.DAuth)
+}
+
+// auditPatch logs and records an Event with the images that would have been rewritten for each container
+func (r *GenericReconciler) auditPatch(ctx context.Context, obj runtime.Object, old, upd *corev1.PodTemplateSpec) {
+	log := log.FromContext(ctx)
+
+	diff := imageDiff(old, upd)
+	if len(diff) == 0 {
+		log.Info("Audit: no rewrite required")
+		return
+	}
+	log.Info("Audit: would rewrite images", "diff", diff)
+	r.event(obj, corev1.EventTypeNormal, "AuditRewrite", "Would rewrite images: %s", strings.Join(diff, ", "))
+}
+
+// event records an Event on the object, if the reconciler has a Recorder
+func (r *GenericReconciler) event(obj runtime.Object, eventtype, reason, messageFmt string, args ...interface{}) {
+	if r.Recorder == nil {
+		return
+	}
+	r.Recorder.Eventf(obj, eventtype, reason, messageFmt, args...)
+}
+
+// imageDiff lists every container whose image differs between old and upd as "container: old -> new"
+func imageDiff(old, upd *corev1.PodTemplateSpec) []string {
+	diff := []string{}
+	for _, conts := range [][2][]corev1.Container{
+		{old.Spec.InitContainers, upd.Spec.InitContainers},
+		{old.Spec.Containers, upd.Spec.Containers},
+	} {
+		for p, cont := range conts[0] {
+			if p < len(conts[1]) && cont.Image != conts[1][p].Image {
+				diff = append(diff, fmt.Sprintf("%s: %s -> %s", cont.Name, cont.Image, conts[1][p].Image))
+			}
 		}
 	}
+	return diff
+}
 
-	for p, cont := range old.Spec.Containers {
-		ref, err := bu.ensureBackup(ctx, cont.Image, r.BuRegRemote)
-		if old.Spec.Containers[p].Image != ref {
-			patchReq = true
-			upd.Spec.Containers[p].Image = ref
+// podImages returns the distinct images used by all containers and init containers of a PodTemplateSpec,
+// except for the containers skip returns true for
+func podImages(pts *corev1.PodTemplateSpec, skip func(corev1.Container) bool) []string {
+	seen := map[string]bool{}
+	imgs := []string{}
+	for _, conts := range [][]corev1.Container{pts.Spec.InitContainers, pts.Spec.Containers} {
+		for _, cont := range conts {
+			if !seen[cont.Image] && !skip(cont) {
+				seen[cont.Image] = true
+				imgs = append(imgs, cont.Image)
+			}
 		}
-		if err != nil {
-			return false, nil, err
+	}
+	return imgs
+}
+
+// resultFromError decides based on the type of a registry error, whether a failed reconcile should be retried.
+// Rate limits are retried after a fixed backoff, errors which will not resolve themselves by retrying
+// (e.g. missing images or bad credentials) are logged and dropped. Everything else is retried with the
+// default exponential backoff of the workqueue.
+func resultFromError(ctx context.Context, err error) (reconcile.Result, error) {
+	log := log.FromContext(ctx)
+
+	switch {
+	case errors.Is(err, registry.ErrRateLimited):
+		log.Info("Rate limited by registry, retrying later", "after", rateLimitBackoff, "error", err.Error())
+		return reconcile.Result{RequeueAfter: rateLimitBackoff}, nil
+	case isPermanent(err):
+		log.Error(err, "Permanent failure during backup, not retrying")
+		return reconcile.Result{}, nil
+	default:
+		return reconcile.Result{}, err
+	}
+}
+
+// isPermanent reports whether retrying will not resolve the error. Aggregated errors are only permanent,
+// if all of their errors are
+func isPermanent(err error) bool {
+	var buErrs BackupErrors
+	if errors.As(err, &buErrs) {
+		for _, e := range buErrs {
+			if !isPermanent(e.Err) {
+				return false
+			}
 		}
+		return len(buErrs) > 0
 	}
-	return patchReq, upd, nil
+	return errors.Is(err, registry.ErrUnauthorized) || errors.Is(err, registry.ErrNotFound) || errors.Is(err, registry.ErrManifestUnknown) ||
+		errors.Is(err, registry.ErrNoMatchingPlatform)
 }
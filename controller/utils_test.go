@@ -2,15 +2,24 @@ package controller
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/google/go-containerregistry/pkg/name"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/simontheleg/image-clone-controller/registry"
+	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
 )
 
 type mockCounter struct {
+	mu                    sync.Mutex
 	referenceExistsCalled int
 	backUpImageCalled     int
 }
@@ -19,12 +28,24 @@ type mockImgExistsReg struct {
 	mockCounter
 }
 
-func (m *mockImgExistsReg) ReferenceExists(ref name.Reference, opts ...remote.Option) (bool, error) {
+func (m *mockImgExistsReg) ReferenceExists(ctx context.Context, ref name.Reference, opts ...remote.Option) (string, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	m.referenceExistsCalled++
-	return true, nil
+	return mockDigest, true, nil
 }
-func (m *mockImgExistsReg) BackUpImage(srcRef, destRef name.Reference, srcOpts, destOpts []remote.Option) error {
+func (m *mockImgExistsReg) BackUpImage(ctx context.Context, srcRef, destRef name.Reference, srcOpts, destOpts []remote.Option) (registry.Copy, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	m.backUpImageCalled++
+	return registry.Copy{SourceDigest: mockDigest, BackupDigest: mockDigest}, nil
+}
+
+func (m *mockImgExistsReg) Size(ctx context.Context, ref name.Reference, opts ...remote.Option) (int64, error) {
+	return mockSize, nil
+}
+
+func (m *mockImgExistsReg) Delete(ctx context.Context, ref name.Reference, opts ...remote.Option) error {
 	return nil
 }
 
@@ -32,15 +53,72 @@ type mockImgNotExistsReg struct {
 	mockCounter
 }
 
-func (m *mockImgNotExistsReg) ReferenceExists(ref name.Reference, opts ...remote.Option) (bool, error) {
+func (m *mockImgNotExistsReg) ReferenceExists(ctx context.Context, ref name.Reference, opts ...remote.Option) (string, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	m.referenceExistsCalled++
-	return false, nil
+	return "", false, nil
 }
-func (m *mockImgNotExistsReg) BackUpImage(srcRef, destRef name.Reference, srcOpts, destOpts []remote.Option) error {
+func (m *mockImgNotExistsReg) BackUpImage(ctx context.Context, srcRef, destRef name.Reference, srcOpts, destOpts []remote.Option) (registry.Copy, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	m.backUpImageCalled++
+	return registry.Copy{SourceDigest: mockDigest, BackupDigest: mockDigest}, nil
+}
+
+func (m *mockImgNotExistsReg) Size(ctx context.Context, ref name.Reference, opts ...remote.Option) (int64, error) {
+	return mockSize, nil
+}
+
+func (m *mockImgNotExistsReg) Delete(ctx context.Context, ref name.Reference, opts ...remote.Option) error {
 	return nil
 }
 
+// mockSlowReg blocks in BackUpImage to track how many backups are running in parallel
+type mockSlowReg struct {
+	mu        sync.Mutex
+	running   int
+	maxRun    int
+	failImage string
+}
+
+func (m *mockSlowReg) ReferenceExists(ctx context.Context, ref name.Reference, opts ...remote.Option) (string, bool, error) {
+	return "", false, nil
+}
+func (m *mockSlowReg) BackUpImage(ctx context.Context, srcRef, destRef name.Reference, srcOpts, destOpts []remote.Option) (registry.Copy, error) {
+	m.mu.Lock()
+	m.running++
+	if m.running > m.maxRun {
+		m.maxRun = m.running
+	}
+	m.mu.Unlock()
+
+	time.Sleep(20 * time.Millisecond)
+
+	m.mu.Lock()
+	m.running--
+	m.mu.Unlock()
+
+	if srcRef.Name() == m.failImage {
+		return registry.Copy{}, registry.ErrNotFound
+	}
+	return registry.Copy{SourceDigest: mockDigest, BackupDigest: mockDigest}, nil
+}
+
+func (m *mockSlowReg) Size(ctx context.Context, ref name.Reference, opts ...remote.Option) (int64, error) {
+	return mockSize, nil
+}
+
+func (m *mockSlowReg) Delete(ctx context.Context, ref name.Reference, opts ...remote.Option) error {
+	return nil
+}
+
+// mockDigest is returned by all mocks as the digest of any image
+const mockDigest = "sha256:9b2a8da1d7a8c2bd1b4a3f6d1d4a3c5e0f1e2d3c4b5a69788796a5b4c3d2e1f0"
+
+// mockSize is returned by all mocks as the size of any image
+const mockSize = 1024
+
 var _ registry.BackUp = (*mockImgExistsReg)(nil)
 
 func TestEnsureBackUp(t *testing.T) {
@@ -73,8 +151,13 @@ func TestEnsureBackUp(t *testing.T) {
 			DAuth: nil,
 		}
 
-		gImg, gErr := b.ensureBackup(context.Background(), tc.img, tc.newReg)
+		skippedBefore := testutil.ToFloat64(backupsSkippedTotal.WithLabelValues("exists"))
+		gBu, gErr := b.ensureBackup(context.Background(), tc.img, tc.newReg)
+		gImg := gBu.ref
 
+		if got := testutil.ToFloat64(backupsSkippedTotal.WithLabelValues("exists")) - skippedBefore; got != 1 {
+			t.Errorf("Exp skipped backups to increase by 1, got %v", got)
+		}
 		if gErr != tc.expErr {
 			t.Errorf("Err: Want '%s', got '%s'", tc.expErr, gErr)
 		}
@@ -106,7 +189,8 @@ func TestEnsureBackUp(t *testing.T) {
 			DAuth: nil,
 		}
 
-		gImg, gErr := b.ensureBackup(context.Background(), tc.img, tc.newReg)
+		gBu, gErr := b.ensureBackup(context.Background(), tc.img, tc.newReg)
+		gImg := gBu.ref
 
 		if gErr != tc.expErr {
 			t.Errorf("Err: Want '%s', got '%s'", tc.expErr, gErr)
@@ -124,6 +208,106 @@ func TestEnsureBackUp(t *testing.T) {
 
 }
 
+func TestEnsureBackUpDigest(t *testing.T) {
+	const orgDigest = "sha256:0f1e2d3c4b5a69788796a5b4c3d2e1f09b2a8da1d7a8c2bd1b4a3f6d1d4a3c5e"
+	tt := map[string]struct {
+		img        string
+		expImg     string
+		expBIcalls int
+	}{
+		"digest reference is pinned to the digest of the backup": {
+			img:        "nginx@" + orgDigest,
+			expImg:     "index.docker.io/test/library_nginx@" + mockDigest,
+			expBIcalls: 1,
+		},
+		"digest reference already in backup repository": {
+			img:        "test/library_nginx@" + mockDigest,
+			expImg:     "index.docker.io/test/library_nginx@" + mockDigest,
+			expBIcalls: 0,
+		},
+	}
+
+	for name, tc := range tt {
+		t.Run(name, func(t *testing.T) {
+			reg := &mockImgNotExistsReg{}
+			b := BackUPer{Reg: reg}
+
+			gBu, gErr := b.ensureBackup(context.Background(), tc.img, "test")
+			gImg := gBu.ref
+			if gErr != nil {
+				t.Fatalf("Exp no error, got '%v'", gErr)
+			}
+			if gImg != tc.expImg {
+				t.Errorf("Image: Want '%s', got '%s'", tc.expImg, gImg)
+			}
+			if reg.backUpImageCalled != tc.expBIcalls {
+				t.Errorf("BackUpImageCalled: Want '%d', got '%d'", tc.expBIcalls, reg.backUpImageCalled)
+			}
+
+			r := GenericReconciler{BuRegRemote: "test"}
+			if !r.isBackupOf(gImg, tc.img) {
+				t.Errorf("Exp '%s' to be the backup of '%s'", gImg, tc.img)
+			}
+		})
+	}
+}
+
+func TestEnsureBackUpEvents(t *testing.T) {
+	tt := map[string]struct {
+		mReg      registry.BackUp
+		img       string
+		expEvents []string
+	}{
+		"backup is created": {
+			mReg:      &mockImgNotExistsReg{},
+			img:       "nginx:latest",
+			expEvents: []string{"Normal BackupStarted", "Normal BackupCompleted"},
+		},
+		"backup already exists": {
+			mReg:      &mockImgExistsReg{},
+			img:       "nginx:latest",
+			expEvents: []string{},
+		},
+		"image already is the backup": {
+			mReg:      &mockImgExistsReg{},
+			img:       "test/library_nginx:latest",
+			expEvents: []string{},
+		},
+		"backup fails": {
+			mReg:      &mockSlowReg{failImage: "index.docker.io/library/nginx:latest"},
+			img:       "nginx:latest",
+			expEvents: []string{"Normal BackupStarted", "Warning BackupFailed"},
+		},
+	}
+
+	for name, tc := range tt {
+		t.Run(name, func(t *testing.T) {
+			recorder := record.NewFakeRecorder(10)
+			b := BackUPer{
+				Reg:      tc.mReg,
+				Recorder: recorder,
+				Obj:      &appsv1.Deployment{},
+			}
+
+			_, _ = b.ensureBackup(context.Background(), tc.img, "test")
+			close(recorder.Events)
+
+			got := []string{}
+			for e := range recorder.Events {
+				got = append(got, e)
+			}
+			if len(got) != len(tc.expEvents) {
+				t.Fatalf("Exp events %v, got %v", tc.expEvents, got)
+			}
+			for p := range tc.expEvents {
+				if !strings.HasPrefix(got[p], tc.expEvents[p]) {
+					t.Errorf("Exp event '%s', got '%s'", tc.expEvents[p], got[p])
+				}
+			}
+		})
+	}
+}
+
 func TestPatchPodSpecAndImage(t *testing.T) {
 	tt := map[string]struct {
 		imgs        []string
@@ -169,7 +353,7 @@ func TestPatchPodSpecAndImage(t *testing.T) {
 
 			ps := specFromImages(tc.imgs, tc.initImgs)
 
-			gotPatch, gotPts, err := rec.patchPodSpecAndImage(context.Background(), *ps)
+			gotPatch, gotPts, _, err := rec.patchPodSpecAndImage(context.Background(), nil, *ps)
 			if err != nil {
 				t.Fatal("patchPodSpecAndImage should not return an error")
 			}
@@ -200,6 +384,254 @@ func TestPatchPodSpecAndImage(t *testing.T) {
 	}
 }
 
+func TestBackUpImages(t *testing.T) {
+	t.Run("images are deduplicated", func(t *testing.T) {
+		reg := &mockImgNotExistsReg{}
+		rec := &GenericReconciler{
+			RegClient:   reg,
+			BuRegRemote: "test",
+		}
+		ps := specFromImages([]string{"nginx:latest", "nginx:latest"}, []string{"nginx:latest"})
+
+		_, gotPts, _, err := rec.patchPodSpecAndImage(context.Background(), nil, *ps)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reg.backUpImageCalled != 1 {
+			t.Errorf("BackUpImageCalled: Want '1', got '%d'", reg.backUpImageCalled)
+		}
+		for _, c := range append(gotPts.Spec.Containers, gotPts.Spec.InitContainers...) {
+			if c.Image != "index.docker.io/test/library_nginx:latest" {
+				t.Errorf("Exp image 'index.docker.io/test/library_nginx:latest', got '%s'", c.Image)
+			}
+		}
+	})
+
+	t.Run("concurrency is capped", func(t *testing.T) {
+		reg := &mockSlowReg{}
+		rec := &GenericReconciler{
+			RegClient:            reg,
+			BuRegRemote:          "test",
+			MaxConcurrentBackups: 2,
+		}
+		imgs := []string{"img-a:1", "img-b:1", "img-c:1", "img-d:1", "img-e:1", "img-f:1"}
+
+		bus := rec.backUpImages(context.Background(), nil, imgs)
+		for img, bu := range bus {
+			if bu.err != nil {
+				t.Errorf("Exp no error for image '%s', got '%v'", img, bu.err)
+			}
+		}
+		if reg.maxRun != 2 {
+			t.Errorf("Exp at most 2 parallel backups, got '%d'", reg.maxRun)
+		}
+	})
+
+	t.Run("error aborts patch", func(t *testing.T) {
+		reg := &mockSlowReg{failImage: "index.docker.io/library/img-b:1"}
+		rec := &GenericReconciler{
+			RegClient:   reg,
+			BuRegRemote: "test",
+		}
+		ps := specFromImages([]string{"img-a:1", "img-b:1", "img-c:1"}, []string{})
+
+		patch, gotPts, _, err := rec.patchPodSpecAndImage(context.Background(), nil, *ps)
+		if !errors.Is(err, registry.ErrNotFound) {
+			t.Errorf("Err: exp '%v', got '%v'", registry.ErrNotFound, err)
+		}
+		if patch || gotPts != nil {
+			t.Error("Exp no patch on error")
+		}
+	})
+
+	t.Run("partial rewrite patches successful containers", func(t *testing.T) {
+		reg := &mockSlowReg{failImage: "index.docker.io/library/img-b:1"}
+		rec := &GenericReconciler{
+			RegClient:      reg,
+			BuRegRemote:    "test",
+			PartialRewrite: true,
+		}
+		ps := specFromImages([]string{"img-a:1", "img-b:1", "img-c:1"}, []string{"img-b:1"})
+
+		patch, gotPts, _, err := rec.patchPodSpecAndImage(context.Background(), nil, *ps)
+		var buErrs BackupErrors
+		if !errors.As(err, &buErrs) {
+			t.Fatalf("Err: exp BackupErrors, got '%v'", err)
+		}
+		if len(buErrs) != 2 {
+			t.Errorf("Exp 2 failed containers, got %d", len(buErrs))
+		}
+		if !errors.Is(err, registry.ErrNotFound) {
+			t.Errorf("Err: exp to wrap '%v', got '%v'", registry.ErrNotFound, err)
+		}
+		if !patch {
+			t.Error("Exp patch for successful containers")
+		}
+
+		expImgs := []string{"index.docker.io/test/library_img-a:1", "img-b:1", "index.docker.io/test/library_img-c:1"}
+		for p := range expImgs {
+			if gotPts.Spec.Containers[p].Image != expImgs[p] {
+				t.Errorf("Containers: Exp image '%s', got '%s'", expImgs[p], gotPts.Spec.Containers[p].Image)
+			}
+		}
+		if gotPts.Spec.InitContainers[0].Image != "img-b:1" {
+			t.Errorf("InitContainers: Exp image 'img-b:1', got '%s'", gotPts.Spec.InitContainers[0].Image)
+		}
+	})
+}
+
+func TestPatchPodSpecAndImageOriginalImages(t *testing.T) {
+	// the digest of the original image is taken from the copy
+	rec := &GenericReconciler{
+		RegClient:   &mockImgNotExistsReg{},
+		BuRegRemote: "test",
+	}
+	ps := specFromImages([]string{"nginx:latest", "redis:6"}, []string{})
+	ps.Spec.Containers[0].Name = "web"
+	ps.Spec.Containers[1].Name = "cache"
+
+	// initial rewrite records both containers
+	patch, upd, _, err := rec.patchPodSpecAndImage(context.Background(), nil, *ps)
+	if err != nil || !patch {
+		t.Fatalf("Exp patch without error, got '%t', '%v'", patch, err)
+	}
+	origs := originalImages(context.Background(), upd)
+	if len(origs) != 2 {
+		t.Fatalf("Exp 2 original images, got %v", origs)
+	}
+	if origs["web"].Image != "nginx:latest" || origs["web"].Digest != mockDigest {
+		t.Errorf("Exp original image 'nginx:latest' with digest '%s', got %v", mockDigest, origs["web"])
+	}
+
+	// subsequent reconciles keep the annotation as is
+	patch, upd2, _, err := rec.patchPodSpecAndImage(context.Background(), nil, *upd)
+	if err != nil || patch {
+		t.Fatalf("Exp no patch without error, got '%t', '%v'", patch, err)
+	}
+	if upd2.Annotations[originalImagesAnnotation] != upd.Annotations[originalImagesAnnotation] {
+		t.Errorf("Exp annotation to stay unchanged, got '%s'", upd2.Annotations[originalImagesAnnotation])
+	}
+
+	// changing an image updates its entry and removing a container drops its entry
+	upd2.Spec.Containers = upd2.Spec.Containers[:1]
+	upd2.Spec.Containers[0].Image = "nginx:1.21"
+	_, upd3, _, err := rec.patchPodSpecAndImage(context.Background(), nil, *upd2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	origs = originalImages(context.Background(), upd3)
+	if len(origs) != 1 || origs["web"].Image != "nginx:1.21" {
+		t.Errorf("Exp only original image 'nginx:1.21' for container 'web', got %v", origs)
+	}
+}
+
+func TestPatchPodSpecAndImageOriginalImagesExistingBackup(t *testing.T) {
+	// without a copy, the digest of the original image is taken from the existing backup
+	rec := &GenericReconciler{
+		RegClient:   &mockImgExistsReg{},
+		BuRegRemote: "test",
+	}
+	ps := specFromImages([]string{"nginx:latest"}, []string{})
+	ps.Spec.Containers[0].Name = "web"
+
+	patch, upd, _, err := rec.patchPodSpecAndImage(context.Background(), nil, *ps)
+	if err != nil || !patch {
+		t.Fatalf("Exp patch without error, got '%t', '%v'", patch, err)
+	}
+	origs := originalImages(context.Background(), upd)
+	if origs["web"].Image != "nginx:latest" || origs["web"].Digest != mockDigest {
+		t.Errorf("Exp original image 'nginx:latest' with digest '%s', got %v", mockDigest, origs["web"])
+	}
+}
+
+func TestPatchPodSpecAndImageSkipContainers(t *testing.T) {
+	reg := &mockImgNotExistsReg{}
+	rec := &GenericReconciler{
+		RegClient:   reg,
+		BuRegRemote: "test",
+	}
+	ps := specFromImages([]string{"nginx:latest", "vendor/fips:1"}, []string{})
+	ps.Spec.Containers[0].Name = "web"
+	ps.Spec.Containers[1].Name = "fips"
+	dep := &appsv1.Deployment{}
+	dep.SetAnnotations(map[string]string{skipContainersAnnotation: "fips, other"})
+
+	patch, upd, _, err := rec.patchPodSpecAndImage(context.Background(), dep, *ps)
+	if err != nil || !patch {
+		t.Fatalf("Exp patch without error, got '%t', '%v'", patch, err)
+	}
+	if got := upd.Spec.Containers[0].Image; got != "index.docker.io/test/library_nginx:latest" {
+		t.Errorf("Exp image 'index.docker.io/test/library_nginx:latest', got '%s'", got)
+	}
+	if got := upd.Spec.Containers[1].Image; got != "vendor/fips:1" {
+		t.Errorf("Exp skipped image to stay 'vendor/fips:1', got '%s'", got)
+	}
+	if reg.backUpImageCalled != 1 {
+		t.Errorf("BackUpImageCalled: Want '1', got '%d'", reg.backUpImageCalled)
+	}
+}
+
+func TestResultFromError(t *testing.T) {
+	tt := map[string]struct {
+		err        error
+		expErr     bool
+		expRequeue bool
+	}{
+		"rate limited is requeued after backoff": {
+			err:        fmt.Errorf("copying image: %w", registry.ErrRateLimited),
+			expErr:     false,
+			expRequeue: true,
+		},
+		"unauthorized is not retried": {
+			err:        registry.ErrUnauthorized,
+			expErr:     false,
+			expRequeue: false,
+		},
+		"missing source image is not retried": {
+			err:        registry.ErrNotFound,
+			expErr:     false,
+			expRequeue: false,
+		},
+		"image without a configured platform is not retried": {
+			err:        fmt.Errorf("copying image: %w", registry.ErrNoMatchingPlatform),
+			expErr:     false,
+			expRequeue: false,
+		},
+		"unavailable is retried with backoff": {
+			err:        registry.ErrUnavailable,
+			expErr:     true,
+			expRequeue: false,
+		},
+		"aggregate of permanent errors is not retried": {
+			err:        BackupErrors{{Err: registry.ErrNotFound}, {Err: registry.ErrUnauthorized}},
+			expErr:     false,
+			expRequeue: false,
+		},
+		"aggregate with a transient error is retried": {
+			err:        BackupErrors{{Err: registry.ErrNotFound}, {Err: registry.ErrUnavailable}},
+			expErr:     true,
+			expRequeue: false,
+		},
+		"unknown errors are retried with backoff": {
+			err:        errors.New("something"),
+			expErr:     true,
+			expRequeue: false,
+		},
+	}
+
+	for name, tc := range tt {
+		t.Run(name, func(t *testing.T) {
+			res, err := resultFromError(context.Background(), tc.err)
+			if (err != nil) != tc.expErr {
+				t.Errorf("Err: exp error '%t', got '%v'", tc.expErr, err)
+			}
+			if (res.RequeueAfter > 0) != tc.expRequeue {
+				t.Errorf("Requeue: exp '%t', got '%v'", tc.expRequeue, res.RequeueAfter)
+			}
+		})
+	}
+}
+
 func specFromImages(images, initImages []string) *corev1.PodTemplateSpec {
 	ret := &corev1.PodTemplateSpec{
 		Spec: corev1.PodSpec{
@@ -0,0 +1,85 @@
+package controller
+
+import (
+	"context"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// rewriteWorkload backs up the images of a workload supported by podTemplate and patches it to use the backups.
+// In ModeAudit the workload is only audited. It returns the images which were, or would have been, rewritten.
+// Backup errors are returned separately in buErr, as the workload may still have been partially rewritten,
+// while err reports that patching the workload failed.
+// If the workload changed since obj was read, it is read again and the patch is computed from its current state
+func (r *GenericReconciler) rewriteWorkload(ctx context.Context, cl client.Client, obj client.Object, kind string) (diff []string, buErr error, err error) {
+	first := true
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		if !first {
+			if err := cl.Get(ctx, client.ObjectKeyFromObject(obj), obj); err != nil {
+				return err
+			}
+		}
+		first = false
+		diff, buErr, err = r.rewriteWorkloadOnce(ctx, cl, obj, kind)
+		return err
+	})
+	if err != nil {
+		r.event(obj, corev1.EventTypeWarning, "RewriteFailed", "Rewriting images failed: %v", err)
+		return nil, buErr, err
+	}
+	return diff, buErr, nil
+}
+
+// rewriteWorkloadOnce works like rewriteWorkload, but fails with a conflict if the workload changed since obj was read
+func (r *GenericReconciler) rewriteWorkloadOnce(ctx context.Context, cl client.Client, obj client.Object, kind string) (diff []string, buErr error, err error) {
+	log := log.FromContext(ctx)
+	key := client.ObjectKeyFromObject(obj)
+	tmpl := podTemplate(obj)
+
+	patchReq, upd, rws, buErr := r.patchPodSpecAndImage(ctx, obj, *tmpl)
+	if upd == nil {
+		return nil, buErr, nil
+	}
+	diff = imageDiff(tmpl, upd)
+
+	if r.Mode == ModeAudit {
+		r.auditPatch(ctx, obj, tmpl, upd)
+		r.auditRewrites(ctx, obj, rws)
+		return diff, buErr, nil
+	}
+
+	newObj := obj.DeepCopyObject().(client.Object)
+	*podTemplate(newObj) = *upd
+	if recordBackupErrors(newObj, buErr) {
+		patchReq = true
+	}
+	if copyOriginalImages(upd, newObj) {
+		patchReq = true
+	}
+
+	if !patchReq {
+		log.Info("No patch required", "kind", kind, "workload", key)
+		return diff, buErr, nil
+	}
+
+	log.Info("Patch required", "kind", kind, "workload", key)
+	patch, err := workloadPatch(obj, newObj, tmpl, upd)
+	if err != nil {
+		return nil, buErr, err
+	}
+	err = cl.Patch(ctx, newObj, client.RawPatch(types.StrategicMergePatchType, patch), client.FieldOwner(fieldManager))
+	if err != nil {
+		return nil, buErr, err
+	}
+	r.auditRewrites(ctx, newObj, rws)
+	if len(diff) > 0 {
+		rewritesTotal.WithLabelValues(kind).Inc()
+		r.event(newObj, corev1.EventTypeNormal, "Rewritten", "Rewrote images: %s", strings.Join(diff, ", "))
+	}
+	return diff, buErr, nil
+}
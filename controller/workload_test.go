@@ -0,0 +1,43 @@
+package controller
+
+import (
+	"context"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestRewriteWorkloadConflict(t *testing.T) {
+	c := fake.NewClientBuilder().WithRuntimeObjects(depFromImages([]string{"nginx:1"}, nil, "test", "test")).Build()
+	stale := &appsv1.Deployment{}
+	if err := c.Get(context.Background(), client.ObjectKey{Namespace: "test", Name: "test"}, stale); err != nil {
+		t.Fatal(err)
+	}
+
+	// the image changes after the reconciler read the workload
+	cur := stale.DeepCopy()
+	cur.Spec.Template.Spec.Containers[0].Image = "nginx:2"
+	if err := c.Update(context.Background(), cur); err != nil {
+		t.Fatal(err)
+	}
+
+	r := GenericReconciler{RegClient: &mockImgExistsReg{}, BuRegRemote: "test"}
+	diff, buErr, err := r.rewriteWorkload(context.Background(), c, stale, "Deployment")
+	if err != nil || buErr != nil {
+		t.Fatalf("Exp no error, got '%v', '%v'", err, buErr)
+	}
+	if len(diff) != 1 {
+		t.Errorf("Exp 1 rewritten image, got %v", diff)
+	}
+
+	got := &appsv1.Deployment{}
+	if err := c.Get(context.Background(), client.ObjectKey{Namespace: "test", Name: "test"}, got); err != nil {
+		t.Fatal(err)
+	}
+	exp := "index.docker.io/test/library_nginx:2"
+	if img := got.Spec.Template.Spec.Containers[0].Image; img != exp {
+		t.Errorf("Exp image '%s', got '%s'", exp, img)
+	}
+}
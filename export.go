@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/simontheleg/image-clone-controller/bundle"
+	"github.com/simontheleg/image-clone-controller/controller"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	kconfig "sigs.k8s.io/controller-runtime/pkg/client/config"
+)
+
+// export writes the images of all watched workloads into a bundle and returns the exit code
+func export(args []string) int {
+	fs := newFlagSet("export")
+	out := fs.String("o", "", "path of the bundle to write")
+	format := fs.String("format", "oci", "'oci' to write an OCI layout directory, 'tar' to write it as a tar archive")
+	imageList := fs.String("images", "", "file listing one image per line to export, instead of the images of all watched workloads")
+	namespace := fs.String("namespace", "", "only export images of workloads in this namespace, defaults to all namespaces")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s export -o <path> [flags]\n\n", os.Args[0])
+		fmt.Fprintln(fs.Output(), "Writes the images of all workloads watched by the controller into a single OCI layout, which")
+		fmt.Fprintln(fs.Output(), "can be imported into the backup registry of a disconnected cluster.")
+		fs.PrintDefaults()
+	}
+	conf, _, err := parseConf(fs, args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid configuration: %v\n", err)
+		return 1
+	}
+	if *out == "" || (*format != "oci" && *format != "tar") {
+		fs.Usage()
+		return 2
+	}
+
+	gRec, err := buildReconciler(conf, nil, nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid configuration: %v\n", err)
+		return 1
+	}
+
+	// already validated by buildReconciler
+	platforms, _ := parsePlatforms(conf.platforms)
+
+	var srcs []bundle.Source
+	if *imageList != "" {
+		srcs, err = readImageList(*imageList)
+	} else {
+		srcs, err = workloadSources(conf, &gRec, *namespace)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not collect images: %v\n", err)
+		return 1
+	}
+
+	dir := *out
+	if *format == "tar" {
+		dir, err = os.MkdirTemp("", "image-clone-export")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not create temporary directory: %v\n", err)
+			return 1
+		}
+		defer os.RemoveAll(dir)
+	}
+
+	failed := 0
+	res, err := bundle.Export(context.Background(), dir, srcs, bundle.ExportOptions{
+		BackupRegistry: conf.buRegRemote,
+		Separator:      conf.separator,
+		Platforms:      platforms,
+		Auth:           gRec.DAuth,
+		Progress: func(done, total int, er bundle.ExportResult) {
+			status := "exported " + er.Digest
+			if er.Err != nil {
+				status = "failed: " + er.Err.Error()
+				failed++
+			}
+			fmt.Printf("[%d/%d] %s %s\n", done, total, er.Source, status)
+		},
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not write bundle: %v\n", err)
+		return 1
+	}
+
+	if *format == "tar" {
+		if err := writeArchive(dir, *out); err != nil {
+			fmt.Fprintf(os.Stderr, "could not write bundle: %v\n", err)
+			return 1
+		}
+	}
+	fmt.Printf("%d image(s) exported to %s, %d failed\n", len(res)-failed, *out, failed)
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// workloadSources returns the original images of all watched workloads, pulling rewritten ones from their backups
+func workloadSources(conf *config, gRec *controller.GenericReconciler, namespace string) ([]bundle.Source, error) {
+	kcfg, err := kconfig.GetConfigWithContext(conf.context)
+	if err != nil {
+		return nil, err
+	}
+	scheme, err := newScheme()
+	if err != nil {
+		return nil, err
+	}
+	cl, err := client.New(kcfg, client.Options{Scheme: scheme})
+	if err != nil {
+		return nil, err
+	}
+
+	imgs, err := controller.WorkloadImages(context.Background(), cl, gRec, namespace)
+	if err != nil {
+		return nil, err
+	}
+	srcs := make([]bundle.Source, 0, len(imgs))
+	for _, img := range imgs {
+		srcs = append(srcs, bundle.Source{Image: img.Image, Pull: img.Current})
+	}
+	return srcs, nil
+}
+
+// readImageList reads one image per line from path. Empty lines and lines starting with '#' are ignored
+func readImageList(path string) ([]bundle.Source, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	srcs := []bundle.Source{}
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		srcs = append(srcs, bundle.Source{Image: line})
+	}
+	return srcs, s.Err()
+}
+
+// writeArchive writes the OCI layout at dir as a tar archive to path
+func writeArchive(dir, path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := bundle.Archive(dir, f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
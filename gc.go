@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/simontheleg/image-clone-controller/controller"
+	"github.com/simontheleg/image-clone-controller/registry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	kconfig "sigs.k8s.io/controller-runtime/pkg/client/config"
+)
+
+// gc garbage collects unreferenced backups once and returns the exit code
+func gc(args []string) int {
+	conf := defaultConf()
+	fs := flag.NewFlagSet("gc", flag.ExitOnError)
+	kubeContext := fs.String("kubecontext", "", "kubernetes context when running locally")
+	dockerConfFile := fs.String("dockerconf", conf.dockerConfFile, "docker config location")
+	dockerConfKey := fs.String("dockerconfkey", conf.dockerConfKey, "subconfig of the docker config to use")
+	gracePeriod := fs.Duration("graceperiod", conf.gcGracePeriod, "how long a backup must be unreferenced before it is deleted")
+	keepLast := fs.Int("keeplast", conf.gcKeepLast, "number of most recent backups per repository which are never deleted")
+	dryRun := fs.Bool("dryrun", false, "only print which backups would be deleted")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s gc [flags]\n\n", os.Args[0])
+		fmt.Fprintln(fs.Output(), "Deletes backups recorded as ImageBackups, which are no longer referenced by any workload.")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	dConf, err := os.Open(*dockerConfFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not access dockerconfig: %v\n", err)
+		return 1
+	}
+	defer dConf.Close()
+	dAuth, err := registry.AuthFromConfig(*dockerConfKey, dConf)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not parse dockerconfig: %v\n", err)
+		return 1
+	}
+
+	kcfg, err := kconfig.GetConfigWithContext(*kubeContext)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not obtain kubeconfig: %v\n", err)
+		return 1
+	}
+	scheme, err := newScheme()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not build scheme: %v\n", err)
+		return 1
+	}
+	cl, err := client.New(kcfg, client.Options{Scheme: scheme})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not create client: %v\n", err)
+		return 1
+	}
+
+	res, err := controller.CollectGarbage(context.Background(), cl, cl, &registry.RegistryBackUp{}, dAuth, controller.GCOptions{
+		GracePeriod: *gracePeriod,
+		KeepLast:    *keepLast,
+		DryRun:      *dryRun,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not collect garbage: %v\n", err)
+		return 1
+	}
+
+	deleted, failed := 0, 0
+	for _, r := range res {
+		status := "kept"
+		switch {
+		case r.Err != nil:
+			status = "failed: " + r.Err.Error()
+			failed++
+		case r.Delete && *dryRun:
+			status = "would delete"
+			deleted++
+		case r.Delete:
+			status = "deleted"
+			deleted++
+		}
+		fmt.Printf("%s %s (%s)\n", r.Backup, status, r.Reason)
+	}
+	fmt.Printf("%d backup(s) processed, %d deleted, %d failed\n", len(res), deleted, failed)
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/simontheleg/image-clone-controller/bundle"
+)
+
+// importBundle pushes the images of a bundle into the backup registry and returns the exit code
+func importBundle(args []string) int {
+	fs := newFlagSet("import")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s import [flags] <bundle>\n\n", os.Args[0])
+		fmt.Fprintln(fs.Output(), "Pushes all images of a bundle written by export into the backup registry, under the references")
+		fmt.Fprintln(fs.Output(), "the controller computes for them. The bundle can be an OCI layout directory or a tar archive.")
+		fs.PrintDefaults()
+	}
+	conf, _, err := parseConf(fs, args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid configuration: %v\n", err)
+		return 1
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	gRec, err := buildReconciler(conf, nil, nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid configuration: %v\n", err)
+		return 1
+	}
+
+	dir := fs.Arg(0)
+	info, err := os.Stat(dir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not read bundle: %v\n", err)
+		return 1
+	}
+	if !info.IsDir() {
+		dir, err = extractArchive(fs.Arg(0))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not read bundle: %v\n", err)
+			return 1
+		}
+		defer os.RemoveAll(dir)
+	}
+
+	failed, skipped := 0, 0
+	res, err := bundle.Import(context.Background(), dir, bundle.ImportOptions{
+		BackupRegistry: conf.buRegRemote,
+		Separator:      conf.separator,
+		Auth:           gRec.DAuth,
+		Progress: func(done, total int, ir bundle.ImportResult) {
+			status := "imported to " + ir.Backup
+			switch {
+			case ir.Err != nil:
+				status = "failed: " + ir.Err.Error()
+				failed++
+			case ir.Skipped:
+				status = "already exists as " + ir.Backup
+				skipped++
+			}
+			fmt.Printf("[%d/%d] %s@%s %s\n", done, total, ir.Source, ir.Digest, status)
+		},
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not read bundle: %v\n", err)
+		return 1
+	}
+	fmt.Printf("%d image(s) processed, %d skipped, %d failed\n", len(res), skipped, failed)
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// extractArchive unpacks the bundle archive at path into a temporary directory and returns it
+func extractArchive(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	dir, err := os.MkdirTemp("", "image-clone-import")
+	if err != nil {
+		return "", err
+	}
+	if err := bundle.Extract(f, dir); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	return dir, nil
+}
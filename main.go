@@ -1,12 +1,29 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"flag"
+	"fmt"
+	"io/ioutil"
 	"os"
+	"strings"
+	"sync"
+	"time"
 
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/simontheleg/image-clone-controller/api/v1alpha1"
+	"github.com/simontheleg/image-clone-controller/auditlog"
+	"github.com/simontheleg/image-clone-controller/configfile"
 	"github.com/simontheleg/image-clone-controller/controller"
 	"github.com/simontheleg/image-clone-controller/registry"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	kconfig "sigs.k8s.io/controller-runtime/pkg/client/config"
+	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 	"sigs.k8s.io/controller-runtime/pkg/manager"
@@ -14,16 +31,76 @@ import (
 )
 
 type config struct {
+	// Location of the configuration file. Flags which are set explicitly take precedence over it
+	configFile string
 	// Kubecontext to use
 	context string
 	// Namespaces to ignore
 	ignNs []string
+	// Label selector namespaces must match to be watched
+	nsSelector string
+	// Label selector of namespaces to ignore
+	nsExcludeSelector string
 	// Docker Remote of Backup Registry
 	buRegRemote string
+	// Separator for nested repositories in backup references
+	separator string
+	// Platforms as os/arch[/variant] to copy from multi-arch images. Empty copies the default platform only
+	platforms []string
 	// Location of Docker config
 	dockerConfFile string
 	// Subconfig to pick in case multiple exist
 	dockerConfKey string
+	// Maximum number of images backed up in parallel per reconcile
+	buConcurrency int
+	// Rewrite successfully backed up containers even if others failed
+	partialRewrite bool
+	// Either enforce or audit
+	mode string
+	// Apply ImageClonePolicies and ClusterImageClonePolicies
+	policies bool
+	// Record backups as ImageBackups
+	inventory bool
+	// Interval of the garbage collection of backups. Zero disables it
+	gcInterval time.Duration
+	// How long a backup must be unreferenced before it is garbage collected
+	gcGracePeriod time.Duration
+	// Number of most recent backups per repository which are never garbage collected
+	gcKeepLast int
+	// Only log which backups would be garbage collected
+	gcDryRun bool
+	// Interval after which the informers deliver all objects again. Zero uses the controller-runtime default
+	syncPeriod time.Duration
+	// Maximum number of Deployments reconciled in parallel
+	depConcurrency int
+	// Maximum number of DaemonSets reconciled in parallel
+	dsConcurrency int
+	// Initial delay of the backoff of failed reconciles
+	rlBaseDelay time.Duration
+	// Maximum delay of the backoff of failed reconciles
+	rlMaxDelay time.Duration
+	// Whether images are still copied in audit mode
+	auditCopy bool
+	// File to append the audit log to, "-" for stdout. Empty disables it
+	auditLog string
+	// File containing the key of the audit log. Required by auditLog
+	auditLogKeyFile string
+	// Exporter of traces, either stdout or otlp. Empty disables tracing
+	tracing string
+	// Endpoint of the OTLP collector as host:port
+	otlpEndpoint string
+	// Connect to the OTLP collector without TLS
+	otlpInsecure bool
+	// Enable leader election to allow running multiple replicas
+	leaderElect bool
+	// Namespace of the leader election lease. Defaults to the namespace the controller is running in
+	leaderElectNs string
+	// Name of the leader election lease
+	leaderElectID string
+	// Address the metrics endpoint binds to
+	metricsAddr string
+	// Address the health and readiness endpoints bind to
+	probeAddr string
 }
 
 func defaultConf() *config {
@@ -31,55 +108,455 @@ func defaultConf() *config {
 		context:        "",
 		ignNs:          []string{"kube-system", "local-path-storage"}, // for the demo to work properly on kind, also ignore local-path-storage
 		buRegRemote:    "imageclonebackupregistry/",
+		separator:      registry.DefaultSeparator,
 		dockerConfFile: "/docker/dockerconfig.json",
 		dockerConfKey:  "dockerhub",
+		buConcurrency:  4,
+		mode:           string(controller.ModeEnforce),
+		gcGracePeriod:  7 * 24 * time.Hour,
+		gcKeepLast:     3,
+		depConcurrency: 1,
+		dsConcurrency:  1,
+		leaderElectID:  "image-clone-controller",
+		metricsAddr:    ":8080",
+		probeAddr:      ":8081",
 	}
 }
 
-func main() {
-	logf.SetLogger(zap.New())
-	var log = logf.Log.WithName("main")
+// stringList is a flag.Value of comma separated strings
+type stringList struct {
+	l *[]string
+}
 
+func (s stringList) String() string {
+	if s.l == nil {
+		return ""
+	}
+	return strings.Join(*s.l, ",")
+}
+
+func (s stringList) Set(v string) error {
+	*s.l = strings.Split(v, ",")
+	return nil
+}
+
+// bindFlags registers all flags of the controller on fs, using the current values of conf as defaults
+func bindFlags(fs *flag.FlagSet, conf *config) {
+	fs.StringVar(&conf.configFile, "config", conf.configFile, "configuration file, which is reloaded on changes. Flags which are set take precedence over it")
+	fs.StringVar(&conf.context, "kubecontext", conf.context, "kubernetes context when running locally")
+	fs.StringVar(&conf.dockerConfFile, "dockerconf", conf.dockerConfFile, "docker config location")
+	fs.StringVar(&conf.dockerConfKey, "dockerconfkey", conf.dockerConfKey, "subconfig of the docker config to use")
+	fs.StringVar(&conf.buRegRemote, "bureg", conf.buRegRemote, "remote registry to use for backup")
+	fs.StringVar(&conf.separator, "separator", conf.separator, "separator replacing slashes of nested repositories in backup references")
+	fs.Var(stringList{&conf.platforms}, "platforms", "comma separated list of platforms like linux/amd64 to copy from multi-arch images, which are backed up as filtered indexes")
+	fs.Var(stringList{&conf.ignNs}, "ignorens", "comma separated list of namespaces to ignore")
+	fs.StringVar(&conf.nsSelector, "nsselector", conf.nsSelector, "only watch namespaces matching this label selector")
+	fs.StringVar(&conf.nsExcludeSelector, "nsexcludeselector", conf.nsExcludeSelector, "ignore namespaces matching this label selector")
+	fs.IntVar(&conf.buConcurrency, "buconcurrency", conf.buConcurrency, "maximum number of images to back up in parallel per reconcile")
+	fs.BoolVar(&conf.partialRewrite, "partialrewrite", conf.partialRewrite, "rewrite successfully backed up containers even if backups for other containers failed")
+	fs.StringVar(&conf.mode, "mode", conf.mode, "'enforce' to back up images and rewrite workloads, 'audit' to only report what would be rewritten")
+	fs.BoolVar(&conf.auditCopy, "auditcopy", conf.auditCopy, "still copy images to the backup registry in audit mode")
+	fs.StringVar(&conf.auditLog, "auditlog", conf.auditLog, "file to append a tamper-evident JSON lines log of all copies and rewrites to, '-' for stdout. Requires -auditlogkeyfile")
+	fs.StringVar(&conf.auditLogKeyFile, "auditlogkeyfile", conf.auditLogKeyFile, "file containing the secret key the entries of the audit log are signed with")
+	fs.StringVar(&conf.tracing, "tracing", conf.tracing, "exporter of OpenTelemetry traces, either 'stdout' or 'otlp'. Empty disables tracing")
+	fs.StringVar(&conf.otlpEndpoint, "otlpendpoint", conf.otlpEndpoint, "host:port of the OTLP/HTTP collector, defaults to localhost:4318 or OTEL_EXPORTER_OTLP_ENDPOINT")
+	fs.BoolVar(&conf.otlpInsecure, "otlpinsecure", conf.otlpInsecure, "connect to the OTLP collector without TLS")
+	fs.BoolVar(&conf.policies, "policies", conf.policies, "apply ImageClonePolicies and ClusterImageClonePolicies, requires their CRDs to be installed")
+	fs.BoolVar(&conf.inventory, "inventory", conf.inventory, "record backups as ImageBackups, requires their CRD to be installed")
+	fs.DurationVar(&conf.gcInterval, "gcinterval", conf.gcInterval, "interval of the garbage collection of unreferenced backups, 0 disables it. Requires -inventory")
+	fs.DurationVar(&conf.gcGracePeriod, "gcgraceperiod", conf.gcGracePeriod, "how long a backup must be unreferenced before it is garbage collected")
+	fs.IntVar(&conf.gcKeepLast, "gckeeplast", conf.gcKeepLast, "number of most recent backups per repository which are never garbage collected")
+	fs.BoolVar(&conf.gcDryRun, "gcdryrun", conf.gcDryRun, "only log which backups would be garbage collected")
+	fs.DurationVar(&conf.syncPeriod, "syncperiod", conf.syncPeriod, "interval after which all workloads are reconciled again, defaults to 10h")
+	fs.IntVar(&conf.depConcurrency, "deploymentconcurrency", conf.depConcurrency, "maximum number of Deployments reconciled in parallel")
+	fs.IntVar(&conf.dsConcurrency, "daemonsetconcurrency", conf.dsConcurrency, "maximum number of DaemonSets reconciled in parallel")
+	fs.DurationVar(&conf.rlBaseDelay, "ratelimitbasedelay", conf.rlBaseDelay, "initial delay of the backoff of failed reconciles, defaults to 5ms")
+	fs.DurationVar(&conf.rlMaxDelay, "ratelimitmaxdelay", conf.rlMaxDelay, "maximum delay of the backoff of failed reconciles, defaults to 1000s")
+	fs.BoolVar(&conf.leaderElect, "leaderelect", conf.leaderElect, "enable leader election to run multiple replicas")
+	fs.StringVar(&conf.leaderElectNs, "leaderelectns", conf.leaderElectNs, "namespace of the leader election lease, defaults to the namespace the controller runs in")
+	fs.StringVar(&conf.leaderElectID, "leaderelectid", conf.leaderElectID, "name of the leader election lease")
+	fs.StringVar(&conf.metricsAddr, "metricsaddr", conf.metricsAddr, "address the metrics endpoint binds to")
+	fs.StringVar(&conf.probeAddr, "probeaddr", conf.probeAddr, "address the health and readiness endpoints bind to")
+}
+
+// loadConf builds the configuration from the defaults, the configuration file at path and the explicitly set flags, in
+// ascending order of precedence
+func loadConf(path string, flags map[string]string) (*config, error) {
 	conf := defaultConf()
+	if path != "" {
+		f, err := configfile.Load(path)
+		if err != nil {
+			return nil, err
+		}
+		conf.applyFile(f)
+	}
+
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	bindFlags(fs, conf)
+	for name, val := range flags {
+		// flags registered by libraries, like -kubeconfig, are not part of the configuration
+		if fs.Lookup(name) == nil {
+			continue
+		}
+		if err := fs.Set(name, val); err != nil {
+			return nil, fmt.Errorf("invalid value for flag -%s: %w", name, err)
+		}
+	}
+	return conf, nil
+}
+
+// applyFile overrides conf with all fields set in the configuration file
+func (conf *config) applyFile(f *configfile.Config) {
+	if f.BackupRegistry != "" {
+		conf.buRegRemote = f.BackupRegistry
+	}
+	if f.Naming.Separator != "" {
+		conf.separator = f.Naming.Separator
+	}
+	if f.Platforms != nil {
+		conf.platforms = f.Platforms
+	}
+	if f.Namespaces.Ignore != nil {
+		conf.ignNs = f.Namespaces.Ignore
+	}
+	if f.Namespaces.Selector != "" {
+		conf.nsSelector = f.Namespaces.Selector
+	}
+	if f.Namespaces.ExcludeSelector != "" {
+		conf.nsExcludeSelector = f.Namespaces.ExcludeSelector
+	}
+	if f.Concurrency.Backups != 0 {
+		conf.buConcurrency = f.Concurrency.Backups
+	}
+	if f.Credentials.DockerConfig != "" {
+		conf.dockerConfFile = f.Credentials.DockerConfig
+	}
+	if f.Credentials.DockerConfigKey != "" {
+		conf.dockerConfKey = f.Credentials.DockerConfigKey
+	}
+	if f.Mode != "" {
+		conf.mode = f.Mode
+	}
+	if f.PartialRewrite != nil {
+		conf.partialRewrite = *f.PartialRewrite
+	}
+	if f.AuditCopy != nil {
+		conf.auditCopy = *f.AuditCopy
+	}
+	if f.AuditLog != "" {
+		conf.auditLog = f.AuditLog
+	}
+	if f.AuditLogKeyFile != "" {
+		conf.auditLogKeyFile = f.AuditLogKeyFile
+	}
+	if f.Tracing.Exporter != "" {
+		conf.tracing = f.Tracing.Exporter
+	}
+	if f.Tracing.Endpoint != "" {
+		conf.otlpEndpoint = f.Tracing.Endpoint
+	}
+	if f.Tracing.Insecure != nil {
+		conf.otlpInsecure = *f.Tracing.Insecure
+	}
+	if f.Reconcile.SyncPeriod != nil {
+		conf.syncPeriod = f.Reconcile.SyncPeriod.Duration
+	}
+	if f.Reconcile.MaxConcurrentReconciles.Deployments != 0 {
+		conf.depConcurrency = f.Reconcile.MaxConcurrentReconciles.Deployments
+	}
+	if f.Reconcile.MaxConcurrentReconciles.DaemonSets != 0 {
+		conf.dsConcurrency = f.Reconcile.MaxConcurrentReconciles.DaemonSets
+	}
+	if f.Reconcile.RateLimiter.BaseDelay != nil {
+		conf.rlBaseDelay = f.Reconcile.RateLimiter.BaseDelay.Duration
+	}
+	if f.Reconcile.RateLimiter.MaxDelay != nil {
+		conf.rlMaxDelay = f.Reconcile.RateLimiter.MaxDelay.Duration
+	}
+}
+
+// parsePlatforms parses platforms as os/arch[/variant], skipping empty ones
+func parsePlatforms(ps []string) ([]v1.Platform, error) {
+	var platforms []v1.Platform
+	for _, p := range ps {
+		if p == "" {
+			continue
+		}
+		platform, err := registry.ParsePlatform(p)
+		if err != nil {
+			return nil, err
+		}
+		platforms = append(platforms, platform)
+	}
+	return platforms, nil
+}
+
+// buildReconciler validates conf and creates the GenericReconciler from it. Credentials are read from disk every time.
+// cl is used to record the inventory if enabled
+func buildReconciler(conf *config, recorder record.EventRecorder, cl client.Client) (controller.GenericReconciler, error) {
+	var err error
+	mode := controller.Mode(conf.mode)
+	if mode != controller.ModeEnforce && mode != controller.ModeAudit {
+		return controller.GenericReconciler{}, fmt.Errorf("unknown mode '%s'", conf.mode)
+	}
+	// flags are not validated by the configuration file
+	if err := configfile.ValidSeparator(conf.separator); err != nil {
+		return controller.GenericReconciler{}, fmt.Errorf("invalid separator: %w", err)
+	}
 
-	flag.StringVar(&conf.context, "kubecontext", conf.context, "kubernetes context when running locally")
-	flag.StringVar(&conf.dockerConfFile, "dockerconf", conf.dockerConfFile, "docker config location")
-	flag.StringVar(&conf.buRegRemote, "bureg", conf.buRegRemote, "remote registry to use for backup")
-	flag.Parse()
+	var nsSel, nsExclSel labels.Selector
+	if conf.nsSelector != "" {
+		nsSel, err = labels.Parse(conf.nsSelector)
+		if err != nil {
+			return controller.GenericReconciler{}, fmt.Errorf("invalid namespace selector: %w", err)
+		}
+	}
+	if conf.nsExcludeSelector != "" {
+		nsExclSel, err = labels.Parse(conf.nsExcludeSelector)
+		if err != nil {
+			return controller.GenericReconciler{}, fmt.Errorf("invalid namespace exclude selector: %w", err)
+		}
+	}
+
+	platforms, err := parsePlatforms(conf.platforms)
+	if err != nil {
+		return controller.GenericReconciler{}, err
+	}
 
 	dConf, err := os.Open(conf.dockerConfFile)
 	if err != nil {
-		log.Error(err, "could not access dockerconfig")
-		os.Exit(1)
+		return controller.GenericReconciler{}, fmt.Errorf("could not access dockerconfig: %w", err)
 	}
+	defer dConf.Close()
 	dAuth, err := registry.AuthFromConfig(conf.dockerConfKey, dConf)
 	if err != nil {
-		log.Error(err, "could not parse dockerconfig")
-		os.Exit(1)
+		return controller.GenericReconciler{}, fmt.Errorf("could not parse dockerconfig: %w", err)
+	}
+
+	var inventory client.Client
+	if conf.inventory {
+		inventory = cl
+	}
+
+	var auditLog auditlog.Sink
+	if conf.auditLog != "" {
+		auditLog, err = openAuditLog(conf.auditLog, conf.auditLogKeyFile)
+		if err != nil {
+			return controller.GenericReconciler{}, fmt.Errorf("could not open audit log: %w", err)
+		}
+	}
+
+	return controller.GenericReconciler{
+		Igns:              conf.ignNs,
+		NsSelector:        nsSel,
+		NsExcludeSelector: nsExclSel,
+		RegClient:         &registry.RegistryBackUp{Platforms: platforms},
+		BuRegRemote:       conf.buRegRemote,
+		Separator:         conf.separator,
+		DAuth:             dAuth,
+
+		MaxConcurrentBackups: conf.buConcurrency,
+		PartialRewrite:       conf.partialRewrite,
+		Mode:                 mode,
+		AuditCopy:            conf.auditCopy,
+		Policies:             conf.policies,
+		Inventory:            inventory,
+		AuditLog:             auditLog,
+		Recorder:             recorder,
+	}, nil
+}
+
+var (
+	auditLogsMu sync.Mutex
+	auditLogs   = map[string]*auditlog.Writer{}
+)
+
+// openAuditLog returns the audit log writing to path, signed with the key in keyFile. Every path is only opened once, so
+// reloading the configuration continues the same chain with the same key
+func openAuditLog(path, keyFile string) (*auditlog.Writer, error) {
+	auditLogsMu.Lock()
+	defer auditLogsMu.Unlock()
+	if w, ok := auditLogs[path]; ok {
+		return w, nil
+	}
+	key, err := readAuditLogKey(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	w, err := auditlog.Open(path, key)
+	if err != nil {
+		return nil, err
+	}
+	auditLogs[path] = w
+	return w, nil
+}
+
+// readAuditLogKey reads the key of the audit log from keyFile, ignoring surrounding whitespace
+func readAuditLogKey(keyFile string) ([]byte, error) {
+	if keyFile == "" {
+		return nil, auditlog.ErrNoKey
+	}
+	key, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimSpace(key), nil
+}
+
+// newScheme returns a scheme containing the builtin types and the API of the controller
+func newScheme() (*runtime.Scheme, error) {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		return nil, err
+	}
+	if err := v1alpha1.AddToScheme(scheme); err != nil {
+		return nil, err
+	}
+	return scheme, nil
+}
+
+func main() {
+	cmd, args := "run", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
+
+	switch cmd {
+	case "run":
+		os.Exit(run(args))
+	case "sync":
+		os.Exit(syncWorkloads(args))
+	case "rewrite":
+		os.Exit(rewrite(args))
+	case "export":
+		os.Exit(export(args))
+	case "import":
+		os.Exit(importBundle(args))
+	case "restore":
+		os.Exit(restore(args))
+	case "gc":
+		os.Exit(gc(args))
+	case "verify-auditlog":
+		os.Exit(verifyAuditLog(args))
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command '%s', expected one of run, sync, rewrite, export, import, restore, gc, verify-auditlog\n", cmd)
+		os.Exit(2)
+	}
+}
+
+// newFlagSet returns a FlagSet for a subcommand, which also contains the flags registered by libraries, like
+// -kubeconfig
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	flag.CommandLine.VisitAll(func(f *flag.Flag) {
+		fs.Var(f.Value, f.Name, f.Usage)
+	})
+	return fs
+}
+
+// parseConf parses args using fs and loads the configuration. It returns the configuration together with the
+// explicitly set flags, so they can be reapplied on top of a reloaded configuration file
+func parseConf(fs *flag.FlagSet, args []string) (*config, map[string]string, error) {
+	bindFlags(fs, defaultConf())
+	_ = fs.Parse(args)
+
+	flags := map[string]string{}
+	fs.Visit(func(f *flag.Flag) {
+		flags[f.Name] = f.Value.String()
+	})
+	conf, err := loadConf(fs.Lookup("config").Value.String(), flags)
+	if err != nil {
+		return nil, nil, err
+	}
+	return conf, flags, nil
+}
+
+// run starts the controller and returns the exit code once it stopped
+func run(args []string) int {
+	logf.SetLogger(zap.New())
+	var log = logf.Log.WithName("main")
+
+	fs := newFlagSet("run")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s [run] [flags]\n\n", os.Args[0])
+		fmt.Fprintln(fs.Output(), "Runs the controller, which backs up and rewrites workloads until it is stopped.")
+		fs.PrintDefaults()
+	}
+	conf, flags, err := parseConf(fs, args)
+	if err != nil {
+		log.Error(err, "invalid configuration")
+		return 1
+	}
+
+	shutdownTracing, err := setupTracing(context.Background(), conf)
+	if err != nil {
+		log.Error(err, "could not set up tracing")
+		return 1
 	}
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			log.Error(err, "could not flush traces")
+		}
+	}()
 
 	kcfg, err := kconfig.GetConfigWithContext(conf.context)
 	if err != nil {
 		log.Error(err, "could not obtain kubeconfig")
-		os.Exit(1)
+		return 1
+	}
+
+	scheme, err := newScheme()
+	if err != nil {
+		log.Error(err, "could not build scheme")
+		return 1
+	}
+
+	var syncPeriod *time.Duration
+	if conf.syncPeriod > 0 {
+		syncPeriod = &conf.syncPeriod
 	}
 
 	var mgr manager.Manager
-	mgr, err = manager.New(kcfg, manager.Options{})
+	mgr, err = manager.New(kcfg, manager.Options{
+		Scheme:                  scheme,
+		SyncPeriod:              syncPeriod,
+		LeaderElection:          conf.leaderElect,
+		LeaderElectionNamespace: conf.leaderElectNs,
+		LeaderElectionID:        conf.leaderElectID,
+		MetricsBindAddress:      conf.metricsAddr,
+		HealthProbeBindAddress:  conf.probeAddr,
+	})
 	if err != nil {
 		log.Error(err, "could not create manager from kubeconfig")
-		os.Exit(1)
+		return 1
+	}
+
+	recorder := mgr.GetEventRecorderFor("image-clone-controller")
+	gRec, err := buildReconciler(conf, recorder, mgr.GetClient())
+	if err != nil {
+		log.Error(err, "invalid configuration")
+		return 1
 	}
+	gRec.Live = controller.NewLiveReconciler(gRec)
 
-	gRec := controller.GenericReconciler{
-		Igns:        conf.ignNs,
-		RegClient:   &registry.RegistryBackUp{},
-		BuRegRemote: conf.buRegRemote,
-		DAuth:       dAuth,
+	err = mgr.AddHealthzCheck("ping", healthz.Ping)
+	if err != nil {
+		log.Error(err, "could not add health check")
+		return 1
+	}
+	err = mgr.AddReadyzCheck("backup-registry", gRec.ReadyzCheck)
+	if err != nil {
+		log.Error(err, "could not add readiness check")
+		return 1
 	}
 
 	dRec := controller.DeploymentReconciler{
 		GenericReconciler: gRec,
+		Controller: controller.ControllerOptions{
+			MaxConcurrentReconciles: conf.depConcurrency,
+			RateLimiterBaseDelay:    conf.rlBaseDelay,
+			RateLimiterMaxDelay:     conf.rlMaxDelay,
+		},
 	}
 	err = dRec.SetupWithManager(mgr)
 	if err != nil {
@@ -88,15 +565,85 @@ func main() {
 
 	dsRec := controller.DaemonSetReconciler{
 		GenericReconciler: gRec,
+		Controller: controller.ControllerOptions{
+			MaxConcurrentReconciles: conf.dsConcurrency,
+			RateLimiterBaseDelay:    conf.rlBaseDelay,
+			RateLimiterMaxDelay:     conf.rlMaxDelay,
+		},
 	}
 	err = dsRec.SetupWithManager(mgr)
 	if err != nil {
 		log.Error(err, "could not create Deployments controller")
 	}
 
-	if err := mgr.Start(signals.SetupSignalHandler()); err != nil {
+	if conf.policies {
+		pRec := controller.PolicyReconciler{}
+		err = pRec.SetupWithManager(mgr)
+		if err != nil {
+			log.Error(err, "could not create ImageClonePolicies controller")
+		}
+
+		cpRec := controller.ClusterPolicyReconciler{}
+		err = cpRec.SetupWithManager(mgr)
+		if err != nil {
+			log.Error(err, "could not create ClusterImageClonePolicies controller")
+		}
+	}
+
+	if conf.gcInterval > 0 && conf.inventory {
+		err = mgr.Add(&controller.GarbageCollector{
+			GenericReconciler: gRec,
+			Client:            mgr.GetClient(),
+			APIReader:         mgr.GetAPIReader(),
+			Interval:          conf.gcInterval,
+			Options: controller.GCOptions{
+				GracePeriod: conf.gcGracePeriod,
+				KeepLast:    conf.gcKeepLast,
+				DryRun:      conf.gcDryRun,
+			},
+		})
+		if err != nil {
+			log.Error(err, "could not add garbage collection")
+		}
+	}
+
+	ctx := signals.SetupSignalHandler()
+	if conf.configFile != "" {
+		go watchConf(ctx, conf.configFile, flags, recorder, mgr.GetClient(), gRec.Live)
+	}
+
+	if err := mgr.Start(ctx); err != nil {
 		log.Error(err, "could not start manager")
-		os.Exit(1)
+		return 1
 	}
+	return 0
+}
 
+// watchConf reloads the configuration whenever the configuration file changes. Invalid configurations are rejected
+// and the previous one is kept
+func watchConf(ctx context.Context, path string, flags map[string]string, recorder record.EventRecorder, cl client.Client, live *controller.LiveReconciler) {
+	log := logf.Log.WithName("config")
+	reload := func() {
+		conf, err := loadConf(path, flags)
+		if err != nil {
+			log.Error(err, "could not reload configuration, keeping the previous one")
+			return
+		}
+		gRec, err := buildReconciler(conf, recorder, cl)
+		if err != nil {
+			log.Error(err, "could not reload configuration, keeping the previous one")
+			return
+		}
+		// backup references of already rewritten workloads depend on the separator
+		if cur := live.Get(); cur != nil && cur.Separator != gRec.Separator {
+			log.Error(fmt.Errorf("naming.separator changed from '%s' to '%s'", cur.Separator, gRec.Separator), "could not reload configuration, the separator can only be changed with a restart, keeping the previous one")
+			return
+		}
+		live.Set(gRec)
+		log.Info("Reloaded configuration", "path", path)
+	}
+
+	if err := configfile.Watch(logf.IntoContext(ctx, log), path, reload); err != nil {
+		log.Error(err, "could not watch configuration file", "path", path)
+	}
 }
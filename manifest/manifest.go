@@ -0,0 +1,224 @@
+// Package manifest finds and rewrites the images of pod templates in Kubernetes YAML manifests
+package manifest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Image is the image of a single container found in a manifest
+type Image struct {
+	// Kind, Namespace and Name of the object containing the pod template
+	Kind      string
+	Namespace string
+	Name      string
+	// Annotations of the object containing the pod template
+	Annotations map[string]string
+	Container   string
+	Image       string
+
+	node *yaml.Node
+}
+
+// podSpecPaths lists the location of the pod spec for all kinds containing one
+var podSpecPaths = map[string][]string{
+	"Pod":                   {"spec"},
+	"PodTemplate":           {"template", "spec"},
+	"Deployment":            {"spec", "template", "spec"},
+	"DaemonSet":             {"spec", "template", "spec"},
+	"StatefulSet":           {"spec", "template", "spec"},
+	"ReplicaSet":            {"spec", "template", "spec"},
+	"ReplicationController": {"spec", "template", "spec"},
+	"Job":                   {"spec", "template", "spec"},
+	"CronJob":               {"spec", "jobTemplate", "spec", "template", "spec"},
+}
+
+// Images returns the images of all containers and init containers in pod templates of the multi document YAML data.
+// Documents of other kinds are ignored. Items of Lists are searched as well
+func Images(data []byte) ([]Image, error) {
+	docs, err := decode(data)
+	if err != nil {
+		return nil, err
+	}
+	imgs := []Image{}
+	for _, doc := range docs {
+		imgs = append(imgs, images(doc)...)
+	}
+	return imgs, nil
+}
+
+// Rewrite replaces the image of every container found by Images with the image returned by rewrite. Only the images
+// themselves are replaced, so comments and formatting of the manifests are preserved
+func Rewrite(data []byte, rewrite func(Image) string) ([]byte, error) {
+	imgs, err := Images(data)
+	if err != nil {
+		return nil, err
+	}
+
+	type replacement struct {
+		Image
+		newImage string
+	}
+	repls := []replacement{}
+	for _, img := range imgs {
+		if newImage := rewrite(img); newImage != img.Image {
+			repls = append(repls, replacement{img, newImage})
+		}
+	}
+	// replace from the end, so the columns of images in the same line stay valid
+	sort.Slice(repls, func(i, j int) bool {
+		if repls[i].node.Line != repls[j].node.Line {
+			return repls[i].node.Line > repls[j].node.Line
+		}
+		return repls[i].node.Column > repls[j].node.Column
+	})
+
+	lines := bytes.Split(data, []byte("\n"))
+	for _, repl := range repls {
+		if err := replace(lines, repl.node, repl.newImage); err != nil {
+			return nil, fmt.Errorf("could not rewrite image of container '%s' in %s %s: %w", repl.Container, repl.Kind, repl.Name, err)
+		}
+	}
+	return bytes.Join(lines, []byte("\n")), nil
+}
+
+// decode parses all documents of data
+func decode(data []byte) ([]*yaml.Node, error) {
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	docs := []*yaml.Node{}
+	for {
+		doc := &yaml.Node{}
+		err := dec.Decode(doc)
+		if errors.Is(err, io.EOF) {
+			return docs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(doc.Content) > 0 {
+			docs = append(docs, doc.Content[0])
+		}
+	}
+}
+
+// images returns the images of the object n
+func images(n *yaml.Node) []Image {
+	if n.Kind != yaml.MappingNode {
+		return nil
+	}
+	kind := value(n, "kind")
+	if strings.HasSuffix(kind, "List") {
+		imgs := []Image{}
+		if items := lookup(n, "items"); items != nil && items.Kind == yaml.SequenceNode {
+			for _, item := range items.Content {
+				imgs = append(imgs, images(item)...)
+			}
+		}
+		return imgs
+	}
+	path, ok := podSpecPaths[kind]
+	if !ok {
+		return nil
+	}
+	spec := lookup(n, path...)
+	if spec == nil {
+		return nil
+	}
+
+	meta := Image{
+		Kind:        kind,
+		Namespace:   value(n, "metadata", "namespace"),
+		Name:        value(n, "metadata", "name"),
+		Annotations: map[string]string{},
+	}
+	if annos := lookup(n, "metadata", "annotations"); annos != nil && annos.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(annos.Content); i += 2 {
+			meta.Annotations[annos.Content[i].Value] = annos.Content[i+1].Value
+		}
+	}
+
+	imgs := []Image{}
+	for _, key := range []string{"initContainers", "containers"} {
+		conts := lookup(spec, key)
+		if conts == nil || conts.Kind != yaml.SequenceNode {
+			continue
+		}
+		for _, cont := range conts.Content {
+			node := lookup(cont, "image")
+			if node == nil || node.Kind != yaml.ScalarNode {
+				continue
+			}
+			img := meta
+			img.Container = value(cont, "name")
+			img.Image = node.Value
+			img.node = node
+			imgs = append(imgs, img)
+		}
+	}
+	return imgs
+}
+
+// lookup returns the node at path below the mapping n, or nil if it does not exist
+func lookup(n *yaml.Node, path ...string) *yaml.Node {
+	for _, key := range path {
+		if n.Kind != yaml.MappingNode {
+			return nil
+		}
+		var next *yaml.Node
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			if n.Content[i].Value == key {
+				next = n.Content[i+1]
+				break
+			}
+		}
+		if next == nil {
+			return nil
+		}
+		n = next
+	}
+	return n
+}
+
+// value returns the scalar at path below the mapping n, or an empty string if it does not exist
+func value(n *yaml.Node, path ...string) string {
+	v := lookup(n, path...)
+	if v == nil || v.Kind != yaml.ScalarNode {
+		return ""
+	}
+	return v.Value
+}
+
+// replace replaces the scalar node in lines with val, keeping its quoting
+func replace(lines [][]byte, node *yaml.Node, val string) error {
+	var quote string
+	switch node.Style {
+	case 0:
+	case yaml.DoubleQuotedStyle:
+		quote = `"`
+	case yaml.SingleQuotedStyle:
+		quote = "'"
+	default:
+		return fmt.Errorf("unsupported style of scalar at line %d", node.Line)
+	}
+
+	if node.Line < 1 || node.Line > len(lines) {
+		return fmt.Errorf("line %d out of range", node.Line)
+	}
+	// columns are counted in characters rather than bytes
+	line := []rune(string(lines[node.Line-1]))
+	start := node.Column - 1
+	old := []rune(quote + node.Value + quote)
+	if start < 0 || start+len(old) > len(line) || string(line[start:start+len(old)]) != string(old) {
+		return fmt.Errorf("unexpected content at line %d, column %d", node.Line, node.Column)
+	}
+
+	updated := string(line[:start]) + quote + val + quote + string(line[start+len(old):])
+	lines[node.Line-1] = []byte(updated)
+	return nil
+}
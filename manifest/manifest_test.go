@@ -0,0 +1,101 @@
+package manifest
+
+import (
+	"strings"
+	"testing"
+)
+
+const manifests = `# the app
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+  namespace: test
+  annotations:
+    image-clone-controller/skip-containers: sidecar
+spec:
+  template:
+    spec:
+      initContainers:
+      - name: init
+        image: "busybox:1.34" # pinned
+      containers:
+      - name: app
+        image: nginx:1.21
+      - {name: sidecar, image: 'envoy:v1'}
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+data:
+  image: nginx:1.21
+---
+apiVersion: v1
+kind: List
+items:
+- apiVersion: batch/v1
+  kind: CronJob
+  metadata:
+    name: job
+  spec:
+    jobTemplate:
+      spec:
+        template:
+          spec:
+            containers: [{name: a, image: alpine:3}, {name: b, image: alpine:3}]
+`
+
+func TestImages(t *testing.T) {
+	imgs, err := Images([]byte(manifests))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := []Image{
+		{Kind: "Deployment", Namespace: "test", Name: "app", Container: "init", Image: "busybox:1.34"},
+		{Kind: "Deployment", Namespace: "test", Name: "app", Container: "app", Image: "nginx:1.21"},
+		{Kind: "Deployment", Namespace: "test", Name: "app", Container: "sidecar", Image: "envoy:v1"},
+		{Kind: "CronJob", Name: "job", Container: "a", Image: "alpine:3"},
+		{Kind: "CronJob", Name: "job", Container: "b", Image: "alpine:3"},
+	}
+	if len(imgs) != len(exp) {
+		t.Fatalf("Exp %d images, got %d: %+v", len(exp), len(imgs), imgs)
+	}
+	for i, e := range exp {
+		got := imgs[i]
+		if got.Kind != e.Kind || got.Namespace != e.Namespace || got.Name != e.Name || got.Container != e.Container || got.Image != e.Image {
+			t.Errorf("Exp image %d to be %+v, got %+v", i, e, got)
+		}
+	}
+	if imgs[0].Annotations["image-clone-controller/skip-containers"] != "sidecar" {
+		t.Errorf("Exp annotations of the workload, got %v", imgs[0].Annotations)
+	}
+}
+
+func TestRewrite(t *testing.T) {
+	out, err := Rewrite([]byte(manifests), func(img Image) string {
+		if img.Container == "sidecar" {
+			return img.Image
+		}
+		return "backup/" + img.Image
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := strings.NewReplacer(
+		`"busybox:1.34"`, `"backup/busybox:1.34"`,
+		"image: nginx:1.21\n      -", "image: backup/nginx:1.21\n      -",
+		"image: alpine:3}", "image: backup/alpine:3}",
+	).Replace(manifests)
+	if string(out) != exp {
+		t.Errorf("Exp:\n%s\ngot:\n%s", exp, out)
+	}
+}
+
+func TestImagesInvalid(t *testing.T) {
+	if _, err := Images([]byte("kind: [")); err == nil {
+		t.Error("Exp error for invalid YAML")
+	}
+}
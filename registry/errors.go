@@ -0,0 +1,92 @@
+package registry
+
+import (
+	"errors"
+	"net"
+	"net/http"
+
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+// Typed errors returned by the registry package. Use errors.Is to check for them.
+// The original error can still be retrieved using errors.As.
+var (
+	ErrNotFound        = errors.New("not found")
+	ErrUnauthorized    = errors.New("unauthorized")
+	ErrRateLimited     = errors.New("rate limited")
+	ErrUnavailable     = errors.New("registry unavailable")
+	ErrManifestUnknown = errors.New("manifest unknown")
+)
+
+// Error wraps an error returned by a registry together with its classification
+type Error struct {
+	Kind error
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Kind.Error() + ": " + e.Err.Error()
+}
+
+func (e *Error) Is(target error) bool {
+	return target == e.Kind
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// ClassifyError maps an error returned by go-containerregistry onto one of the typed errors, for callers using
+// go-containerregistry directly
+func ClassifyError(err error) error {
+	return classifyError(err)
+}
+
+// classifyError maps an error returned by go-containerregistry onto one of the typed errors.
+// Errors which cannot be classified are returned unchanged
+func classifyError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if kind := errorKind(err); kind != nil {
+		return &Error{Kind: kind, Err: err}
+	}
+	return err
+}
+
+func errorKind(err error) error {
+	var tErr *transport.Error
+	if errors.As(err, &tErr) {
+		// diagnostics are more specific than the status code, so check them first
+		for _, d := range tErr.Errors {
+			switch d.Code {
+			case transport.ManifestUnknownErrorCode:
+				return ErrManifestUnknown
+			case transport.NameUnknownErrorCode, transport.BlobUnknownErrorCode:
+				return ErrNotFound
+			case transport.UnauthorizedErrorCode, transport.DeniedErrorCode:
+				return ErrUnauthorized
+			case transport.TooManyRequestsErrorCode:
+				return ErrRateLimited
+			}
+		}
+
+		switch {
+		case tErr.StatusCode == http.StatusNotFound:
+			return ErrNotFound
+		case tErr.StatusCode == http.StatusUnauthorized, tErr.StatusCode == http.StatusForbidden:
+			return ErrUnauthorized
+		case tErr.StatusCode == http.StatusTooManyRequests:
+			return ErrRateLimited
+		case tErr.StatusCode == http.StatusRequestTimeout, tErr.StatusCode >= http.StatusInternalServerError:
+			return ErrUnavailable
+		}
+		return nil
+	}
+
+	var nErr net.Error
+	if errors.As(err, &nErr) {
+		return ErrUnavailable
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package registry
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+func TestClassifyError(t *testing.T) {
+	tt := map[string]struct {
+		err error
+		exp error
+	}{
+		"manifest unknown diagnostic": {
+			err: &transport.Error{StatusCode: http.StatusNotFound, Errors: []transport.Diagnostic{{Code: transport.ManifestUnknownErrorCode}}},
+			exp: ErrManifestUnknown,
+		},
+		"plain not found": {
+			err: &transport.Error{StatusCode: http.StatusNotFound},
+			exp: ErrNotFound,
+		},
+		"unauthorized": {
+			err: &transport.Error{StatusCode: http.StatusUnauthorized},
+			exp: ErrUnauthorized,
+		},
+		"denied diagnostic": {
+			err: &transport.Error{StatusCode: http.StatusBadRequest, Errors: []transport.Diagnostic{{Code: transport.DeniedErrorCode}}},
+			exp: ErrUnauthorized,
+		},
+		"rate limited": {
+			err: &transport.Error{StatusCode: http.StatusTooManyRequests},
+			exp: ErrRateLimited,
+		},
+		"server error": {
+			err: &transport.Error{StatusCode: http.StatusBadGateway},
+			exp: ErrUnavailable,
+		},
+		"network error": {
+			err: &net.OpError{Op: "dial", Err: errors.New("connection refused")},
+			exp: ErrUnavailable,
+		},
+	}
+
+	for n, tc := range tt {
+		t.Run(n, func(t *testing.T) {
+			got := classifyError(tc.err)
+			if !errors.Is(got, tc.exp) {
+				t.Errorf("Exp error of kind '%v', got '%v'", tc.exp, got)
+			}
+			if !errors.Is(got, tc.err) {
+				t.Errorf("Classified error '%v' does not wrap original error '%v'", got, tc.err)
+			}
+		})
+	}
+
+	unknown := errors.New("something else")
+	if got := classifyError(unknown); got != unknown {
+		t.Errorf("Exp unclassifiable error to be returned unchanged, got '%v'", got)
+	}
+}
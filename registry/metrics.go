@@ -0,0 +1,55 @@
+package registry
+
+import (
+	"errors"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var (
+	backupsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "image_clone_controller_backups_total",
+		Help: "Number of images copied to the backup registry, by result",
+	}, []string{"result"})
+	transferredBytesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "image_clone_controller_transferred_bytes_total",
+		Help: "Compressed size of all layers uploaded to the backup registry. Layers which already existed are not counted",
+	})
+	transferredLayersTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "image_clone_controller_transferred_layers_total",
+		Help: "Number of layers uploaded to the backup registry. Layers which already existed are not counted",
+	})
+	referenceExistsDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "image_clone_controller_reference_exists_duration_seconds",
+		Help:    "Latency of checking whether a reference exists in a registry, by result",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"result"})
+)
+
+func init() {
+	metrics.Registry.MustRegister(
+		backupsTotal,
+		transferredBytesTotal,
+		transferredLayersTotal,
+		referenceExistsDuration,
+	)
+}
+
+// errorResult returns a metrics label value for the result of a registry operation
+func errorResult(err error) string {
+	switch {
+	case err == nil:
+		return "success"
+	case errors.Is(err, ErrNotFound), errors.Is(err, ErrManifestUnknown):
+		return "not_found"
+	case errors.Is(err, ErrUnauthorized):
+		return "unauthorized"
+	case errors.Is(err, ErrRateLimited):
+		return "rate_limited"
+	case errors.Is(err, ErrUnavailable):
+		return "unavailable"
+	default:
+		return "error"
+	}
+}
@@ -0,0 +1,59 @@
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+)
+
+// ErrNoMatchingPlatform is returned when no manifest of an index matches the allowed platforms
+var ErrNoMatchingPlatform = errors.New("no manifest matches the allowed platforms")
+
+// ParsePlatform parses a platform in the form os/arch[/variant], e.g. linux/arm64 or linux/arm/v7
+func ParsePlatform(s string) (v1.Platform, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return v1.Platform{}, fmt.Errorf("invalid platform '%s', expected os/arch[/variant]", s)
+	}
+	p := v1.Platform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		p.Variant = parts[2]
+	}
+	return p, nil
+}
+
+// matchesPlatform reports whether p matches any of allowed. A variant is only compared if the allowed platform has one
+func matchesPlatform(p *v1.Platform, allowed []v1.Platform) bool {
+	if p == nil {
+		return false
+	}
+	for _, a := range allowed {
+		if p.OS == a.OS && p.Architecture == a.Architecture && (a.Variant == "" || p.Variant == a.Variant) {
+			return true
+		}
+	}
+	return false
+}
+
+// FilterIndex removes all manifests from idx, whose platform does not match any of allowed
+func FilterIndex(idx v1.ImageIndex, allowed []v1.Platform) (v1.ImageIndex, error) {
+	m, err := idx.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+	matched := 0
+	for _, desc := range m.Manifests {
+		if matchesPlatform(desc.Platform, allowed) {
+			matched++
+		}
+	}
+	if matched == 0 {
+		return nil, ErrNoMatchingPlatform
+	}
+	return mutate.RemoveManifests(idx, func(desc v1.Descriptor) bool {
+		return !matchesPlatform(desc.Platform, allowed)
+	}), nil
+}
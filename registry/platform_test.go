@@ -0,0 +1,182 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+func TestParsePlatform(t *testing.T) {
+	tt := map[string]struct {
+		in     string
+		exp    v1.Platform
+		expErr bool
+	}{
+		"os and arch": {
+			in:  "linux/amd64",
+			exp: v1.Platform{OS: "linux", Architecture: "amd64"},
+		},
+		"with variant": {
+			in:  "linux/arm/v7",
+			exp: v1.Platform{OS: "linux", Architecture: "arm", Variant: "v7"},
+		},
+		"missing arch": {
+			in:     "linux",
+			expErr: true,
+		},
+		"empty arch": {
+			in:     "linux/",
+			expErr: true,
+		},
+		"too many components": {
+			in:     "linux/arm/v7/extra",
+			expErr: true,
+		},
+	}
+
+	for n, tc := range tt {
+		t.Run(n, func(t *testing.T) {
+			got, err := ParsePlatform(tc.in)
+			if (err != nil) != tc.expErr {
+				t.Fatalf("Exp error '%t', got '%v'", tc.expErr, err)
+			}
+			if !tc.expErr && !got.Equals(tc.exp) {
+				t.Errorf("Exp '%+v', got '%+v'", tc.exp, got)
+			}
+		})
+	}
+}
+
+func TestMatchesPlatform(t *testing.T) {
+	allowed := []v1.Platform{{OS: "linux", Architecture: "amd64"}, {OS: "linux", Architecture: "arm", Variant: "v7"}}
+	tt := map[string]struct {
+		p   *v1.Platform
+		exp bool
+	}{
+		"matching":                  {p: &v1.Platform{OS: "linux", Architecture: "amd64"}, exp: true},
+		"variant not restricted":    {p: &v1.Platform{OS: "linux", Architecture: "amd64", Variant: "v3"}, exp: true},
+		"matching variant":          {p: &v1.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}, exp: true},
+		"other variant":             {p: &v1.Platform{OS: "linux", Architecture: "arm", Variant: "v6"}, exp: false},
+		"other architecture":        {p: &v1.Platform{OS: "linux", Architecture: "s390x"}, exp: false},
+		"other os":                  {p: &v1.Platform{OS: "windows", Architecture: "amd64"}, exp: false},
+		"manifest without platform": {p: nil, exp: false},
+	}
+
+	for n, tc := range tt {
+		t.Run(n, func(t *testing.T) {
+			if got := matchesPlatform(tc.p, allowed); got != tc.exp {
+				t.Errorf("Exp '%t', got '%t'", tc.exp, got)
+			}
+		})
+	}
+}
+
+func TestBackUpImagePlatforms(t *testing.T) {
+	reg := httptest.NewServer(registry.New(registry.Logger(log.New(ioutil.Discard, "", 0))))
+	defer reg.Close()
+	host := strings.TrimPrefix(reg.URL, "http://")
+
+	platforms := []v1.Platform{
+		{OS: "linux", Architecture: "amd64"},
+		{OS: "linux", Architecture: "arm64"},
+		{OS: "linux", Architecture: "s390x"},
+	}
+	var idx v1.ImageIndex = empty.Index
+	for i := range platforms {
+		img, err := random.Image(1024, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		idx = mutate.AppendManifests(idx, mutate.IndexAddendum{Add: img, Descriptor: v1.Descriptor{Platform: &platforms[i]}})
+	}
+	src, _ := name.ParseReference(host + "/vendor/app:v1")
+	if err := remote.WriteIndex(src, idx); err != nil {
+		t.Fatal(err)
+	}
+	srcDigest, _ := idx.Digest()
+
+	tt := map[string]struct {
+		platforms    []v1.Platform
+		expPlatforms []string
+		expErr       error
+	}{
+		"no platforms copies the default platform": {
+			expPlatforms: nil,
+		},
+		"matching platforms": {
+			platforms:    []v1.Platform{{OS: "linux", Architecture: "amd64"}, {OS: "linux", Architecture: "arm64"}},
+			expPlatforms: []string{"linux/amd64", "linux/arm64"},
+		},
+		"no matching platform": {
+			platforms: []v1.Platform{{OS: "windows", Architecture: "amd64"}},
+			expErr:    ErrNoMatchingPlatform,
+		},
+	}
+
+	for n, tc := range tt {
+		t.Run(n, func(t *testing.T) {
+			r := RegistryBackUp{Platforms: tc.platforms}
+			dest, _ := name.ParseReference(host + "/backup/" + strings.ReplaceAll(n, " ", "-") + ":v1")
+			c, err := r.BackUpImage(context.Background(), src, dest, nil, nil)
+			if !errors.Is(err, tc.expErr) {
+				t.Fatalf("Exp error '%v', got '%v'", tc.expErr, err)
+			}
+			if tc.expErr != nil {
+				return
+			}
+
+			desc, err := remote.Get(dest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.expPlatforms == nil {
+				if desc.MediaType.IsIndex() {
+					t.Errorf("Exp a single image, got '%s'", desc.MediaType)
+				}
+				// the copied image of the default platform is recorded instead of the index
+				if c.SourceDigest != desc.Digest.String() || c.BackupDigest != desc.Digest.String() {
+					t.Errorf("Exp copy of '%s', got %+v", desc.Digest, c)
+				}
+				return
+			}
+			if desc.Digest.String() == srcDigest.String() {
+				t.Error("Exp digest of filtered index to differ from the original")
+			}
+			if c.SourceDigest != srcDigest.String() || c.BackupDigest != desc.Digest.String() {
+				t.Errorf("Exp copy of '%s' to '%s', got %+v", srcDigest, desc.Digest, c)
+			}
+			got, err := desc.ImageIndex()
+			if err != nil {
+				t.Fatal(err)
+			}
+			m, err := got.IndexManifest()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(m.Manifests) != len(tc.expPlatforms) {
+				t.Fatalf("Exp %d manifests, got %d", len(tc.expPlatforms), len(m.Manifests))
+			}
+			for i, child := range m.Manifests {
+				if p := child.Platform.OS + "/" + child.Platform.Architecture; p != tc.expPlatforms[i] {
+					t.Errorf("Exp platform '%s', got '%s'", tc.expPlatforms[i], p)
+				}
+				// the child manifests and their blobs must have been copied as well
+				if _, err := remote.Image(dest.Context().Digest(child.Digest.String())); err != nil {
+					t.Errorf("Exp child manifest %s to exist, got '%v'", child.Digest, err)
+				}
+			}
+		})
+	}
+}
@@ -1,56 +1,245 @@
 package registry
 
 import (
+	"context"
+	"errors"
 	"io"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/docker/cli/cli/config"
 	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
 	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// BackUp is the interface to the registries. All methods pass ctx on to the requests and trace them as part of it
 type BackUp interface {
-	ReferenceExists(name.Reference, ...remote.Option) (bool, error)
-	BackUpImage(name.Reference, name.Reference, []remote.Option, []remote.Option) error
+	ReferenceExists(context.Context, name.Reference, ...remote.Option) (string, bool, error)
+	BackUpImage(context.Context, name.Reference, name.Reference, []remote.Option, []remote.Option) (Copy, error)
+	Size(context.Context, name.Reference, ...remote.Option) (int64, error)
+	Delete(context.Context, name.Reference, ...remote.Option) error
 }
 
-type RegistryBackUp struct{}
+// Copy describes the manifest copied by BackUpImage
+type Copy struct {
+	// Digest of the source manifest which was copied. For indexes resolved to a single platform, it is the digest of
+	// the platform's image
+	SourceDigest string
+	// Digest of the backup. It differs from SourceDigest if platforms of an index were filtered
+	BackupDigest string
+}
+
+type RegistryBackUp struct {
+	// Only copy the manifests of these platforms from image indexes. Empty copies the default platform as a single image
+	Platforms []v1.Platform
+}
 
 var _ BackUp = (*RegistryBackUp)(nil)
 
-// ReferenceExists checks if the specified reference exists in the registry.
+// ReferenceExists checks if the specified reference exists in the registry and returns the digest it points to.
 // For private registries you can pass credentials as options.
-func (*RegistryBackUp) ReferenceExists(ref name.Reference, opts ...remote.Option) (bool, error) {
-	_, err := remote.Get(ref, opts...)
-	if err != nil {
-		if cast, ok := err.(*transport.Error); ok {
-			if cast.StatusCode == http.StatusNotFound {
-				return false, nil
-			} else {
-				return false, err
-			}
+// Any error other than the reference not being found is returned as one of the typed registry errors.
+func (*RegistryBackUp) ReferenceExists(ctx context.Context, ref name.Reference, opts ...remote.Option) (digest string, exists bool, err error) {
+	ctx, span := tracer.Start(ctx, "ReferenceExists", trace.WithAttributes(attribute.String("reference", ref.Name())))
+	start := time.Now()
+	defer func() {
+		result := errorResult(err)
+		if err == nil && !exists {
+			result = "not_found"
+		}
+		referenceExistsDuration.WithLabelValues(result).Observe(time.Since(start).Seconds())
+		span.SetAttributes(attribute.Bool("exists", exists))
+		endSpan(span, err)
+	}()
+
+	desc, err := remote.Get(ref, withContext(ctx, opts)...)
+	if err != nil {
+		err = classifyError(err)
+		if errors.Is(err, ErrNotFound) || errors.Is(err, ErrManifestUnknown) {
+			return "", false, nil
 		}
+		return "", false, err
 	}
-	return true, nil
+	return desc.Digest.String(), true, nil
 }
 
 // BackUpImage copies a docker image from one registry to another.
 // To check if the destination image already exists, call ReferenceExists first.
-func (*RegistryBackUp) BackUpImage(srcRef, destRef name.Reference, srcOpts, destOpts []remote.Option) error {
-	img, err := remote.Image(srcRef, srcOpts...)
+// Layers are uploaded in parallel before the manifest, each in its own span.
+// If Platforms are set and srcRef points to an image index, an index with only the manifests of these platforms is written.
+// Its digest differs from the original one.
+// The digests of the copied manifest and of the backup are returned, so they do not need to be resolved again
+func (r *RegistryBackUp) BackUpImage(ctx context.Context, srcRef, destRef name.Reference, srcOpts, destOpts []remote.Option) (c Copy, err error) {
+	ctx, span := tracer.Start(ctx, "BackUpImage", trace.WithAttributes(
+		attribute.String("source", srcRef.Name()),
+		attribute.String("destination", destRef.Name()),
+	))
+	defer func() {
+		backupsTotal.WithLabelValues(errorResult(err)).Inc()
+		endSpan(span, err)
+	}()
+	srcOpts = withContext(ctx, srcOpts)
+	destOpts = withContext(ctx, destOpts)
+
+	desc, err := remote.Get(srcRef, srcOpts...)
+	if err != nil {
+		return Copy{}, classifyError(err)
+	}
+	if len(r.Platforms) > 0 && desc.MediaType.IsIndex() {
+		return r.backUpIndex(ctx, span, desc, destRef, destOpts)
+	}
+
+	img, err := desc.Image()
+	if err != nil {
+		return Copy{}, classifyError(err)
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		return Copy{}, classifyError(err)
+	}
+	layers, size, err := imageLayers(img)
 	if err != nil {
-		return err
+		return Copy{}, classifyError(err)
 	}
+	span.SetAttributes(attribute.Int("layers", len(layers)), attribute.Int64("size", size))
 
+	uploaded, uploadedSize, err := writeLayers(ctx, destRef.Context(), layers, destOpts)
+	transferredBytesTotal.Add(float64(uploadedSize))
+	transferredLayersTotal.Add(float64(uploaded))
+	if err != nil {
+		return Copy{}, classifyError(err)
+	}
+	// all layers exist already, so only the config and manifest are uploaded
 	err = remote.Write(destRef, img, destOpts...)
 	if err != nil {
-		return err
+		return Copy{}, classifyError(err)
+	}
+	return Copy{SourceDigest: digest.String(), BackupDigest: digest.String()}, nil
+}
+
+// backUpIndex copies the manifests of the allowed platforms of an image index and writes a filtered index pointing to them
+func (r *RegistryBackUp) backUpIndex(ctx context.Context, span trace.Span, desc *remote.Descriptor, destRef name.Reference, destOpts []remote.Option) (Copy, error) {
+	idx, err := desc.ImageIndex()
+	if err != nil {
+		return Copy{}, classifyError(err)
+	}
+	idx, err = FilterIndex(idx, r.Platforms)
+	if err != nil {
+		return Copy{}, err
+	}
+	digest, err := idx.Digest()
+	if err != nil {
+		return Copy{}, classifyError(err)
+	}
+	m, err := idx.IndexManifest()
+	if err != nil {
+		return Copy{}, classifyError(err)
+	}
+
+	var layers []v1.Layer
+	var size int64
+	for _, child := range m.Manifests {
+		if !child.MediaType.IsImage() {
+			continue
+		}
+		img, err := idx.Image(child.Digest)
+		if err != nil {
+			return Copy{}, classifyError(err)
+		}
+		ls, s, err := imageLayers(img)
+		if err != nil {
+			return Copy{}, classifyError(err)
+		}
+		layers = append(layers, ls...)
+		size += s
+	}
+	span.SetAttributes(attribute.Int("manifests", len(m.Manifests)), attribute.Int("layers", len(layers)), attribute.Int64("size", size))
+
+	uploaded, uploadedSize, err := writeLayers(ctx, destRef.Context(), layers, destOpts)
+	transferredBytesTotal.Add(float64(uploadedSize))
+	transferredLayersTotal.Add(float64(uploaded))
+	if err != nil {
+		return Copy{}, classifyError(err)
+	}
+	// all layers exist already, so only the configs and manifests are uploaded
+	if err := remote.WriteIndex(destRef, idx, destOpts...); err != nil {
+		return Copy{}, classifyError(err)
+	}
+	return Copy{SourceDigest: desc.Digest.String(), BackupDigest: digest.String()}, nil
+}
+
+// imageLayers returns the layers of img and their total compressed size
+func imageLayers(img v1.Image) ([]v1.Layer, int64, error) {
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, 0, err
+	}
+	var size int64
+	for _, l := range layers {
+		s, err := l.Size()
+		if err != nil {
+			return nil, 0, err
+		}
+		size += s
+	}
+	return layers, size, nil
+}
+
+// Digest returns the digest the reference currently points to
+func (*RegistryBackUp) Digest(ctx context.Context, ref name.Reference, opts ...remote.Option) (digest string, err error) {
+	ctx, span := tracer.Start(ctx, "Digest", trace.WithAttributes(attribute.String("reference", ref.Name())))
+	defer func() { endSpan(span, err) }()
+
+	desc, err := remote.Head(ref, withContext(ctx, opts)...)
+	if err != nil {
+		return "", classifyError(err)
+	}
+	return desc.Digest.String(), nil
+}
+
+// Size returns the compressed size of the config and all layers of the image the reference points to
+func (*RegistryBackUp) Size(ctx context.Context, ref name.Reference, opts ...remote.Option) (size int64, err error) {
+	ctx, span := tracer.Start(ctx, "Size", trace.WithAttributes(attribute.String("reference", ref.Name())))
+	defer func() { endSpan(span, err) }()
+
+	img, err := remote.Image(ref, withContext(ctx, opts)...)
+	if err != nil {
+		return 0, classifyError(err)
 	}
+	m, err := img.Manifest()
+	if err != nil {
+		return 0, classifyError(err)
+	}
+	size = m.Config.Size
+	for _, l := range m.Layers {
+		size += l.Size
+	}
+	return size, nil
+}
 
-	return nil
+// Delete removes the manifest the reference points to. Deleting a digest reference removes all tags pointing to it.
+// Many registries only support deleting digest references
+func (*RegistryBackUp) Delete(ctx context.Context, ref name.Reference, opts ...remote.Option) (err error) {
+	ctx, span := tracer.Start(ctx, "Delete", trace.WithAttributes(attribute.String("reference", ref.Name())))
+	defer func() { endSpan(span, err) }()
+
+	return classifyError(remote.Delete(ref, withContext(ctx, opts)...))
+}
+
+// Ping checks whether the registry hosting repo is reachable and accepts the credentials for pulling from repo.
+// A nil auth is treated as anonymous access
+func Ping(ctx context.Context, repo name.Repository, auth authn.Authenticator) error {
+	if auth == nil {
+		auth = authn.Anonymous
+	}
+	_, err := transport.NewWithContext(ctx, repo.Registry, auth, http.DefaultTransport, []string{repo.Scope(transport.PullScope)})
+	return classifyError(err)
 }
 
 // AuthFromConfig extracts a remote.Option compatible authn.Authenticator from a Docker config.
@@ -75,13 +264,26 @@ func AuthFromConfig(reg string, conf io.Reader) (authn.Authenticator, error) {
 	}), nil
 }
 
+// DefaultSeparator replaces the slashes of nested repositories in backup references
+const DefaultSeparator = "_"
+
 // GenBackUpReference returns an escaped Reference, which includes the BackupRegistry and is Docker compatible
 // It ensures the repo is not multi-nested
 func GenBackUpReference(reg string, ref name.Reference) string {
+	return GenBackUpReferenceWithSeparator(reg, ref, DefaultSeparator)
+}
+
+// GenBackUpReferenceWithSeparator works like GenBackUpReference, but escapes nested repositories using sep.
+// An empty sep uses the DefaultSeparator. Digest references are backed up as tags like sha256-<hex>, as the digest of
+// the backup may differ from the original one
+func GenBackUpReferenceWithSeparator(reg string, ref name.Reference, sep string) string {
+	if sep == "" {
+		sep = DefaultSeparator
+	}
 	if reg[len(reg)-1:] != "/" {
 		reg += "/"
 	}
 	escpRepo := strings.Replace(ref.Context().RepositoryStr(), reg, "", 1)
-	escpRepo = strings.Replace(escpRepo, "/", "_", -1)
-	return reg + escpRepo + ":" + ref.Identifier()
+	escpRepo = strings.Replace(escpRepo, "/", sep, -1)
+	return reg + escpRepo + ":" + strings.Replace(ref.Identifier(), ":", "-", 1)
 }
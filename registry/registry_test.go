@@ -1,12 +1,22 @@
 package registry
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
 
 	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func TestGenBackUpReference(t *testing.T) {
@@ -35,6 +45,11 @@ func TestGenBackUpReference(t *testing.T) {
 			img: "imageclonebackupregistry/simontheleg_debug-pod:latest",
 			exp: "imageclonebackupregistry/simontheleg_debug-pod:latest",
 		},
+		"digest reference": {
+			reg: "imageclonebackupregistry/",
+			img: "nginx@sha256:bd8ee4de2a0d6b4a11d6a0bfb8c8e0ca8a0bdfa95b3b1f0cb5c5e3aeb1e5b1dc",
+			exp: "imageclonebackupregistry/library_nginx:sha256-bd8ee4de2a0d6b4a11d6a0bfb8c8e0ca8a0bdfa95b3b1f0cb5c5e3aeb1e5b1dc",
+		},
 		"registry must be escaped": {
 			reg: "noslashregistry",
 			img: "noslashregistry/simontheleg_debug-pod:latest",
@@ -58,6 +73,207 @@ func TestGenBackUpReference(t *testing.T) {
 
 }
 
+func TestReferenceExists(t *testing.T) {
+	reg := httptest.NewServer(registry.New(registry.Logger(log.New(ioutil.Discard, "", 0))))
+	defer reg.Close()
+	host := strings.TrimPrefix(reg.URL, "http://")
+
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	existing, _ := name.ParseReference(host + "/test/existing:latest")
+	if err := remote.Write(existing, img); err != nil {
+		t.Fatal(err)
+	}
+	imgDigest, _ := img.Digest()
+
+	unauthorized := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/" {
+			return
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer unauthorized.Close()
+
+	tt := map[string]struct {
+		ref       string
+		expExists bool
+		expDigest string
+		expErr    error
+	}{
+		"image exists": {
+			ref:       host + "/test/existing:latest",
+			expExists: true,
+			expDigest: imgDigest.String(),
+		},
+		"image does not exist": {
+			ref:       host + "/test/missing:latest",
+			expExists: false,
+		},
+		"unauthorized": {
+			ref:       strings.TrimPrefix(unauthorized.URL, "http://") + "/test/existing:latest",
+			expExists: false,
+			expErr:    ErrUnauthorized,
+		},
+	}
+
+	r := RegistryBackUp{}
+	for n, tc := range tt {
+		t.Run(n, func(t *testing.T) {
+			ref, err := name.ParseReference(tc.ref)
+			if err != nil {
+				t.Fatal(err)
+			}
+			digest, exists, err := r.ReferenceExists(context.Background(), ref)
+			if exists != tc.expExists {
+				t.Errorf("Exists: exp '%t', got '%t'", tc.expExists, exists)
+			}
+			if digest != tc.expDigest {
+				t.Errorf("Digest: exp '%s', got '%s'", tc.expDigest, digest)
+			}
+			if tc.expErr == nil && err != nil {
+				t.Errorf("Err: exp nil, got '%v'", err)
+			}
+			if tc.expErr != nil && !errors.Is(err, tc.expErr) {
+				t.Errorf("Err: exp '%v', got '%v'", tc.expErr, err)
+			}
+		})
+	}
+}
+
+func TestBackUpImage(t *testing.T) {
+	reg := httptest.NewServer(registry.New(registry.Logger(log.New(ioutil.Discard, "", 0))))
+	defer reg.Close()
+	host := strings.TrimPrefix(reg.URL, "http://")
+	// the test registry shares blobs between repositories, so backups go to a separate one
+	buReg := httptest.NewServer(registry.New(registry.Logger(log.New(ioutil.Discard, "", 0))))
+	defer buReg.Close()
+	buHost := strings.TrimPrefix(buReg.URL, "http://")
+
+	img, err := random.Image(1024, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, _ := name.ParseReference(host + "/vendor/app:v1")
+	if err := remote.Write(src, img); err != nil {
+		t.Fatal(err)
+	}
+
+	successBefore := testutil.ToFloat64(backupsTotal.WithLabelValues("success"))
+	notFoundBefore := testutil.ToFloat64(backupsTotal.WithLabelValues("not_found"))
+	layersBefore := testutil.ToFloat64(transferredLayersTotal)
+	bytesBefore := testutil.ToFloat64(transferredBytesTotal)
+
+	r := RegistryBackUp{}
+	dest, _ := name.ParseReference(buHost + "/backup/vendor_app:v1")
+	c, err := r.BackUpImage(context.Background(), src, dest, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, exists, err := r.ReferenceExists(context.Background(), dest)
+	if err != nil || !exists {
+		t.Errorf("Exp backup to exist, got '%t', '%v'", exists, err)
+	}
+	// layers which already exist in the backup repository are not uploaded again
+	copyDest, _ := name.ParseReference(buHost + "/backup/vendor_app:v1-copy")
+	if _, err := r.BackUpImage(context.Background(), src, copyDest, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	expDigest, _ := img.Digest()
+	if c.SourceDigest != expDigest.String() || c.BackupDigest != expDigest.String() {
+		t.Errorf("Copy: exp digests '%s', got %+v", expDigest, c)
+	}
+	if got, err := r.Digest(context.Background(), dest); err != nil || got != expDigest.String() {
+		t.Errorf("Digest: exp '%s', got '%s', '%v'", expDigest, got, err)
+	}
+	m, _ := img.Manifest()
+	expSize := m.Config.Size
+	for _, l := range m.Layers {
+		expSize += l.Size
+	}
+	if got, err := r.Size(context.Background(), dest); err != nil || got != expSize {
+		t.Errorf("Size: exp '%d', got '%d', '%v'", expSize, got, err)
+	}
+	if err := r.Delete(context.Background(), dest.Context().Digest(expDigest.String())); err != nil {
+		t.Errorf("Delete: exp no error, got '%v'", err)
+	}
+	if _, exists, err := r.ReferenceExists(context.Background(), dest.Context().Digest(expDigest.String())); err != nil || exists {
+		t.Errorf("Exp backup to be deleted, got '%t', '%v'", exists, err)
+	}
+
+	missing, _ := name.ParseReference(host + "/vendor/missing:v1")
+	if _, err := r.BackUpImage(context.Background(), missing, dest, nil, nil); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Err: exp '%v', got '%v'", ErrNotFound, err)
+	}
+
+	if got := testutil.ToFloat64(backupsTotal.WithLabelValues("success")) - successBefore; got != 2 {
+		t.Errorf("Exp 2 successful backups, got %v", got)
+	}
+	if got := testutil.ToFloat64(backupsTotal.WithLabelValues("not_found")) - notFoundBefore; got != 1 {
+		t.Errorf("Exp 1 failed backup, got %v", got)
+	}
+	if got := testutil.ToFloat64(transferredLayersTotal) - layersBefore; got != 3 {
+		t.Errorf("Exp 3 transferred layers, got %v", got)
+	}
+	if got := testutil.ToFloat64(transferredBytesTotal) - bytesBefore; got <= 3*1024 || got >= 2*3*1024 {
+		t.Errorf("Exp the layers of one copy to be transferred, got %v bytes", got)
+	}
+	if got := testutil.CollectAndCount(referenceExistsDuration); got == 0 {
+		t.Error("Exp reference exists latency to be observed")
+	}
+}
+
+func TestPing(t *testing.T) {
+	reg := httptest.NewServer(registry.New(registry.Logger(log.New(ioutil.Discard, "", 0))))
+	defer reg.Close()
+
+	unavailable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unavailable.Close()
+
+	tt := map[string]struct {
+		url    string
+		expErr error
+	}{
+		"registry reachable": {
+			url: reg.URL,
+		},
+		"registry unavailable": {
+			url:    unavailable.URL,
+			expErr: ErrUnavailable,
+		},
+	}
+
+	for n, tc := range tt {
+		t.Run(n, func(t *testing.T) {
+			repo, err := name.NewRepository(strings.TrimPrefix(tc.url, "http://") + "/backup")
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = Ping(context.Background(), repo, nil)
+			if tc.expErr == nil && err != nil {
+				t.Errorf("Err: exp nil, got '%v'", err)
+			}
+			if tc.expErr != nil && !errors.Is(err, tc.expErr) {
+				t.Errorf("Err: exp '%v', got '%v'", tc.expErr, err)
+			}
+		})
+	}
+}
+
+func TestGenBackUpReferenceWithSeparator(t *testing.T) {
+	ref, err := name.ParseReference("quay.io/prometheus/node-exporter:v1.2.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := "imageclonebackupregistry/prometheus--node-exporter:v1.2.2"
+	if got := GenBackUpReferenceWithSeparator("imageclonebackupregistry/", ref, "--"); got != exp {
+		t.Errorf("Exp: '%s', got '%s'", exp, got)
+	}
+}
+
 // Integration tests begin here
 func TestImageExistsIntegration(t *testing.T) {
 	if testing.Short() {
@@ -67,7 +283,7 @@ func TestImageExistsIntegration(t *testing.T) {
 	r := RegistryBackUp{}
 
 	ref, _ := name.ParseReference("imageclonebackupregistry/nginx:latest")
-	exists, err := r.ReferenceExists(ref)
+	_, exists, err := r.ReferenceExists(context.Background(), ref)
 
 	fmt.Printf("Exists: %t\n", exists)
 	if err != nil {
@@ -96,7 +312,7 @@ func TestBackUpImageIntegration(t *testing.T) {
 
 	src, _ := name.ParseReference("nginx:1.21.0")
 	dest, _ := name.ParseReference("imageclonebackupregistry/nginx:1.21.0")
-	err = r.BackUpImage(src, dest, nil, []remote.Option{remote.WithAuth(auth)})
+	_, err = r.BackUpImage(context.Background(), src, dest, nil, []remote.Option{remote.WithAuth(auth)})
 
 	if err != nil {
 		fmt.Println(err)
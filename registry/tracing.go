@@ -0,0 +1,108 @@
+package registry
+
+import (
+	"context"
+	"sync"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// maxParallelLayers is the number of layers uploaded in parallel per image, matching remote.Write
+const maxParallelLayers = 4
+
+var tracer = otel.Tracer("github.com/simontheleg/image-clone-controller/registry")
+
+// endSpan records err on span and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// withContext returns a copy of opts, which passes ctx on to the requests
+func withContext(ctx context.Context, opts []remote.Option) []remote.Option {
+	return append(append(make([]remote.Option, 0, len(opts)+1), opts...), remote.WithContext(ctx))
+}
+
+// writeLayers uploads all layers to repo, each in its own span, and returns the first error.
+// It returns the number and compressed size of the layers, which did not exist in repo yet and were uploaded
+func writeLayers(ctx context.Context, repo name.Repository, layers []v1.Layer, opts []remote.Option) (uploaded int, size int64, err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		once sync.Once
+		sem  = make(chan struct{}, maxParallelLayers)
+	)
+	for _, l := range layers {
+		wg.Add(1)
+		go func(l v1.Layer) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			s, werr := writeLayer(ctx, repo, l, opts)
+			if werr != nil {
+				once.Do(func() {
+					err = werr
+					cancel()
+				})
+				return
+			}
+			if s >= 0 {
+				mu.Lock()
+				uploaded++
+				size += s
+				mu.Unlock()
+			}
+		}(l)
+	}
+	wg.Wait()
+	return uploaded, size, err
+}
+
+// writeLayer uploads a single layer to repo and returns its compressed size. Layers which already exist in repo are
+// skipped and reported with a size of -1
+func writeLayer(ctx context.Context, repo name.Repository, l v1.Layer, opts []remote.Option) (size int64, err error) {
+	ctx, span := tracer.Start(ctx, "UploadLayer")
+	defer func() { endSpan(span, err) }()
+	opts = withContext(ctx, opts)
+
+	digest, err := l.Digest()
+	if err != nil {
+		return -1, err
+	}
+	size, err = l.Size()
+	if err != nil {
+		return -1, err
+	}
+	span.SetAttributes(attribute.String("digest", digest.String()), attribute.Int64("size", size))
+
+	existing, err := remote.Layer(repo.Digest(digest.String()), opts...)
+	if err != nil {
+		return -1, err
+	}
+	exists, err := partial.Exists(existing)
+	if err != nil {
+		return -1, err
+	}
+	span.SetAttributes(attribute.Bool("exists", exists))
+	if exists {
+		return -1, nil
+	}
+	if err := remote.WriteLayer(repo, l, opts...); err != nil {
+		return -1, err
+	}
+	return size, nil
+}
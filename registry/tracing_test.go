@@ -0,0 +1,64 @@
+package registry
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestBackUpImageTracing(t *testing.T) {
+	sr := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr)))
+
+	reg := httptest.NewServer(registry.New(registry.Logger(log.New(ioutil.Discard, "", 0))))
+	defer reg.Close()
+	host := strings.TrimPrefix(reg.URL, "http://")
+
+	img, err := random.Image(1024, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, _ := name.ParseReference(host + "/vendor/app:v1")
+	if err := remote.Write(src, img); err != nil {
+		t.Fatal(err)
+	}
+	dest, _ := name.ParseReference(host + "/backup/vendor_app:v1")
+
+	r := RegistryBackUp{}
+	if _, err := r.BackUpImage(context.Background(), src, dest, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var parent sdktrace.ReadOnlySpan
+	uploads := []sdktrace.ReadOnlySpan{}
+	for _, s := range sr.Ended() {
+		switch s.Name() {
+		case "BackUpImage":
+			parent = s
+		case "UploadLayer":
+			uploads = append(uploads, s)
+		}
+	}
+	if parent == nil {
+		t.Fatal("Exp BackUpImage span")
+	}
+	if len(uploads) != 3 {
+		t.Fatalf("Exp 3 UploadLayer spans, got %d", len(uploads))
+	}
+	for _, u := range uploads {
+		if u.Parent().SpanID() != parent.SpanContext().SpanID() {
+			t.Errorf("Exp UploadLayer to be a child of BackUpImage")
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/simontheleg/image-clone-controller/configfile"
+	"github.com/simontheleg/image-clone-controller/controller"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	kconfig "sigs.k8s.io/controller-runtime/pkg/client/config"
+)
+
+// restore reverts all selected workloads to their original images and returns the exit code
+func restore(args []string) int {
+	fs := newFlagSet("restore")
+	namespace := fs.String("namespace", "", "only restore workloads in this namespace, defaults to all namespaces")
+	selector := fs.String("selector", "", "only restore workloads matching this label selector")
+	dryRun := fs.Bool("dryrun", false, "only print which images would be restored")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s restore [flags]\n\n", os.Args[0])
+		fmt.Fprintln(fs.Output(), "Reverts Deployments and DaemonSets to the original images recorded by the controller.")
+		fmt.Fprintln(fs.Output(), "Stop the controller first, otherwise it will rewrite the workloads again. Containers whose image")
+		fmt.Fprintln(fs.Output(), "is no longer the backup of its original image according to -bureg and -separator are skipped.")
+		fs.PrintDefaults()
+	}
+	conf, _, err := parseConf(fs, args)
+	if err == nil {
+		err = configfile.ValidSeparator(conf.separator)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid configuration: %v\n", err)
+		return 1
+	}
+
+	sel, err := labels.Parse(*selector)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid selector: %v\n", err)
+		return 1
+	}
+
+	kcfg, err := kconfig.GetConfigWithContext(conf.context)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not obtain kubeconfig: %v\n", err)
+		return 1
+	}
+	cl, err := client.New(kcfg, client.Options{})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not create client: %v\n", err)
+		return 1
+	}
+
+	res, err := controller.Restore(context.Background(), cl, controller.RestoreOptions{
+		Namespace:      *namespace,
+		Selector:       sel,
+		DryRun:         *dryRun,
+		BackupRegistry: conf.buRegRemote,
+		Separator:      conf.separator,
+	})
+
+	failed := 0
+	for _, rw := range res {
+		status := "restored"
+		if *dryRun {
+			status = "would restore"
+		}
+		if rw.Err != nil {
+			status = "failed: " + rw.Err.Error()
+			failed++
+		}
+		fmt.Printf("%s %s/%s %s: %s\n", rw.Kind, rw.Namespace, rw.Name, status, strings.Join(rw.Diff, ", "))
+		if len(rw.Skipped) > 0 {
+			fmt.Printf("%s %s/%s skipped changed images: %s\n", rw.Kind, rw.Namespace, rw.Name, strings.Join(rw.Skipped, ", "))
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not list workloads: %v\n", err)
+		return 1
+	}
+	fmt.Printf("%d workload(s) processed, %d failed\n", len(res), failed)
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/simontheleg/image-clone-controller/controller"
+	"sigs.k8s.io/yaml"
+)
+
+// rewrite backs up the images of manifests on disk, rewrites the manifests and returns the exit code
+func rewrite(args []string) int {
+	fs := newFlagSet("rewrite")
+	kustomize := fs.String("kustomize", "", "instead of rewriting the manifests, write a Kustomize Component with an images patch to this file")
+	dryRun := fs.Bool("dryrun", false, "only print which images would be rewritten, without backing them up")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s rewrite [flags] <file or directory>...\n\n", os.Args[0])
+		fmt.Fprintln(fs.Output(), "Backs up the images of all pod templates in Kubernetes YAML manifests and rewrites the manifests")
+		fmt.Fprintln(fs.Output(), "in place, so the change can be committed to a GitOps repository. Directories are searched for")
+		fmt.Fprintln(fs.Output(), "*.yaml and *.yml files recursively.")
+		fs.PrintDefaults()
+	}
+	conf, _, err := parseConf(fs, args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid configuration: %v\n", err)
+		return 1
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+	files, err := manifestFiles(fs.Args())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not find manifests: %v\n", err)
+		return 1
+	}
+
+	// the inventory requires a cluster, so it is not recorded
+	gRec, err := buildReconciler(conf, nil, nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid configuration: %v\n", err)
+		return 1
+	}
+	write := !*dryRun && gRec.Mode != controller.ModeAudit
+	// a dry run must not push to the backup registry
+	gRec.SkipCopy = *dryRun
+
+	failed := 0
+	rws := []controller.ManifestRewrite{}
+	for _, f := range files {
+		data, err := ioutil.ReadFile(f)
+		if err != nil {
+			fmt.Printf("%s: failed: %v\n", f, err)
+			failed++
+			continue
+		}
+		out, fileRws, err := gRec.RewriteManifest(context.Background(), data)
+		if err != nil {
+			fmt.Printf("%s: failed: %v\n", f, err)
+			failed++
+		}
+		if out == nil {
+			continue
+		}
+
+		status := "rewrote"
+		if !write {
+			status = "would rewrite"
+		}
+		for _, rw := range fileRws {
+			obj := rw.Name
+			if rw.Namespace != "" {
+				obj = rw.Namespace + "/" + rw.Name
+			}
+			fmt.Printf("%s: %s %s %s container '%s': %s -> %s\n", f, rw.Kind, obj, status, rw.Container, rw.Image.Image, rw.Backup)
+		}
+		rws = append(rws, fileRws...)
+		if !write || *kustomize != "" || len(fileRws) == 0 {
+			continue
+		}
+		if err := writeFile(f, out); err != nil {
+			fmt.Printf("%s: failed: %v\n", f, err)
+			failed++
+		}
+	}
+
+	if write && *kustomize != "" {
+		if err := writeKustomizeComponent(*kustomize, rws); err != nil {
+			fmt.Fprintf(os.Stderr, "could not write Kustomize Component: %v\n", err)
+			return 1
+		}
+		fmt.Printf("Wrote Kustomize Component to %s\n", *kustomize)
+	}
+
+	fmt.Printf("%d file(s) processed, %d image(s) rewritten, %d failed\n", len(files), len(rws), failed)
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// manifestFiles returns all files in paths. Directories are searched for YAML files recursively
+func manifestFiles(paths []string) ([]string, error) {
+	files := []string{}
+	for _, p := range paths {
+		err := filepath.Walk(p, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				return nil
+			}
+			ext := filepath.Ext(path)
+			if path == p || ext == ".yaml" || ext == ".yml" {
+				files = append(files, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// writeFile replaces the content of the existing file at path, keeping its permissions
+func writeFile(path string, data []byte) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, info.Mode())
+}
+
+type kustomizeImage struct {
+	Name    string `json:"name"`
+	NewName string `json:"newName"`
+	NewTag  string `json:"newTag,omitempty"`
+	Digest  string `json:"digest,omitempty"`
+}
+
+type kustomizeComponent struct {
+	APIVersion string           `json:"apiVersion"`
+	Kind       string           `json:"kind"`
+	Images     []kustomizeImage `json:"images"`
+}
+
+// writeKustomizeComponent writes a Kustomize Component to path, which rewrites the images to their backups.
+// Kustomize matches images by name only, so all images of the same name must be rewritten the same way
+func writeKustomizeComponent(path string, rws []controller.ManifestRewrite) error {
+	images := map[string]kustomizeImage{}
+	for _, rw := range rws {
+		img, err := kustomizeImageOf(rw)
+		if err != nil {
+			return err
+		}
+		if prev, ok := images[img.Name]; ok && prev != img {
+			return fmt.Errorf("images named %s are rewritten to different backups, which a Kustomize images patch cannot express", img.Name)
+		}
+		images[img.Name] = img
+	}
+
+	comp := kustomizeComponent{
+		APIVersion: "kustomize.config.k8s.io/v1alpha1",
+		Kind:       "Component",
+		Images:     []kustomizeImage{},
+	}
+	for _, img := range images {
+		comp.Images = append(comp.Images, img)
+	}
+	sort.Slice(comp.Images, func(i, j int) bool { return comp.Images[i].Name < comp.Images[j].Name })
+
+	data, err := yaml.Marshal(comp)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// kustomizeImageOf returns the images entry replacing the image of rw with its backup. Backups of tags keep the tag,
+// while backups of digests are pinned to the digest of the backup
+func kustomizeImageOf(rw controller.ManifestRewrite) (kustomizeImage, error) {
+	orgRef, err := name.ParseReference(rw.Image.Image)
+	if err != nil {
+		return kustomizeImage{}, err
+	}
+	buRef, err := name.ParseReference(rw.Backup)
+	if err != nil {
+		return kustomizeImage{}, err
+	}
+
+	img := kustomizeImage{Name: imageName(rw.Image.Image), NewName: buRef.Context().Name()}
+	switch bu := buRef.(type) {
+	case name.Digest:
+		img.Digest = bu.DigestStr()
+	case name.Tag:
+		if org, ok := orgRef.(name.Tag); !ok || org.TagStr() != bu.TagStr() {
+			img.NewTag = bu.TagStr()
+		}
+	}
+	return img, nil
+}
+
+// imageName strips the tag and digest from image, as Kustomize matches images by the name used in the manifests
+func imageName(image string) string {
+	image = strings.SplitN(image, "@", 2)[0]
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		image = image[:i]
+	}
+	return image
+}
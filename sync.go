@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/simontheleg/image-clone-controller/controller"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	kconfig "sigs.k8s.io/controller-runtime/pkg/client/config"
+)
+
+// syncWorkloads backs up and rewrites all workloads once and returns the exit code
+func syncWorkloads(args []string) int {
+	fs := newFlagSet("sync")
+	namespace := fs.String("namespace", "", "only sync workloads in this namespace, defaults to all namespaces")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s sync [flags]\n\n", os.Args[0])
+		fmt.Fprintln(fs.Output(), "Backs up the images of all Deployments and DaemonSets and rewrites them once, using the same")
+		fmt.Fprintln(fs.Output(), "configuration as the controller. Useful to onboard a new cluster.")
+		fs.PrintDefaults()
+	}
+	conf, _, err := parseConf(fs, args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid configuration: %v\n", err)
+		return 1
+	}
+
+	kcfg, err := kconfig.GetConfigWithContext(conf.context)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not obtain kubeconfig: %v\n", err)
+		return 1
+	}
+	scheme, err := newScheme()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not build scheme: %v\n", err)
+		return 1
+	}
+	cl, err := client.New(kcfg, client.Options{Scheme: scheme})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not create client: %v\n", err)
+		return 1
+	}
+	gRec, err := buildReconciler(conf, nil, cl)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid configuration: %v\n", err)
+		return 1
+	}
+
+	failed, skipped := 0, 0
+	res, err := controller.Sync(context.Background(), cl, &gRec, controller.SyncOptions{
+		Namespace: *namespace,
+		Progress: func(done, total int, sr controller.SyncResult) {
+			status := "up to date"
+			switch {
+			case sr.Err != nil:
+				status = "failed: " + sr.Err.Error()
+				failed++
+			case sr.Skipped != "":
+				status = "skipped: " + sr.Skipped
+				skipped++
+			case len(sr.Diff) > 0 && sr.Audit:
+				status = "would rewrite " + strings.Join(sr.Diff, ", ")
+			case len(sr.Diff) > 0:
+				status = "rewrote " + strings.Join(sr.Diff, ", ")
+			}
+			fmt.Printf("[%d/%d] %s %s/%s %s\n", done, total, sr.Kind, sr.Namespace, sr.Name, status)
+		},
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not list workloads: %v\n", err)
+		return 1
+	}
+	fmt.Printf("%d workload(s) processed, %d skipped, %d failed\n", len(res), skipped, failed)
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/simontheleg/image-clone-controller/auditlog"
+)
+
+// verifyAuditLog checks the hash chain of audit logs and returns the exit code
+func verifyAuditLog(args []string) int {
+	fs := newFlagSet("verify-auditlog")
+	keyFile := fs.String("auditlogkeyfile", "", "file containing the secret key the audit logs were signed with")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s verify-auditlog -auditlogkeyfile <file> <file>...\n\n", os.Args[0])
+		fmt.Fprintln(fs.Output(), "Verifies that no entries of audit logs written with -auditlog were modified or removed.")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+	key, err := readAuditLogKey(*keyFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not read key: %v\n", err)
+		return 1
+	}
+
+	failed := 0
+	for _, path := range fs.Args() {
+		n, err := verifyFile(path, key)
+		if err != nil {
+			fmt.Printf("%s: invalid: %v\n", path, err)
+			failed++
+			continue
+		}
+		fmt.Printf("%s: valid, %d entries\n", path, n)
+	}
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// verifyFile verifies the audit log at path, which was signed with key, and returns the number of entries
+func verifyFile(path string, key []byte) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return auditlog.Verify(f, key)
+}